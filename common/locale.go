@@ -0,0 +1,88 @@
+package common
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Supported message languages.
+const (
+	LangZH = "zh-CN"
+	LangEN = "en"
+)
+
+// LocaleEnv overrides the system locale for the command line tools.
+const LocaleEnv = "SIMPLEAUTH_LOCALE"
+
+// Messages holds a message catalog per language.
+type Messages map[string]map[string]string
+
+// Get returns the message for key in lang, falling back to zh-CN and then
+// to key itself.
+func (m Messages) Get(lang, key string) string {
+	if msg, ok := m[lang][key]; ok {
+		return msg
+	}
+	if msg, ok := m[LangZH][key]; ok {
+		return msg
+	}
+	return key
+}
+
+// MatchLanguage returns the supported language preferred by s, which is
+// an Accept-Language header or a locale such as "en_US.UTF-8". It returns
+// "" when s names no supported language.
+func MatchLanguage(s string) string {
+	type tag struct {
+		lang string
+		q    float64
+	}
+	var tags []tag
+	for _, part := range strings.Split(s, ",") {
+		fields := strings.Split(part, ";")
+		lang := strings.TrimSpace(fields[0])
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if lang != "" && q > 0 {
+			tags = append(tags, tag{lang, q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+	for _, t := range tags {
+		lang := strings.ToLower(t.lang)
+		if i := strings.IndexAny(lang, ".@"); i >= 0 {
+			lang = lang[:i]
+		}
+		switch strings.SplitN(strings.Replace(lang, "_", "-", -1), "-", 2)[0] {
+		case "zh":
+			return LangZH
+		case "en":
+			return LangEN
+		}
+	}
+	return ""
+}
+
+// Locale returns the language of a command line tool: the flag value if
+// set, then $SIMPLEAUTH_LOCALE, $LC_ALL, $LC_MESSAGES and $LANG, then def.
+func Locale(flagValue, def string) string {
+	candidates := []string{flagValue}
+	for _, env := range []string{LocaleEnv, "LC_ALL", "LC_MESSAGES", "LANG"} {
+		candidates = append(candidates, os.Getenv(env))
+	}
+	for _, c := range candidates {
+		if lang := MatchLanguage(c); lang != "" {
+			return lang
+		}
+	}
+	return def
+}
@@ -0,0 +1,7 @@
+// +build !windows
+
+package common
+
+// PipeAddr is where the daemon's named pipe would be. Named pipes exist
+// only on Windows; elsewhere the daemon does not open one.
+const PipeAddr = ""
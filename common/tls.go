@@ -0,0 +1,33 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// ClientTLSConfig returns the TLS settings for connecting to the daemon:
+// caFile, when set, replaces the system roots, and certFile and keyFile,
+// when set, are presented as the client certificate.
+func ClientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	tc := &tls.Config{}
+	if caFile != "" {
+		buf, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(buf) {
+			return nil, errors.New(caFile + ": no certificates found")
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
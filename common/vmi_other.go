@@ -0,0 +1,36 @@
+// +build !windows
+
+package common
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+var errNoProc = errors.New("no process list in /proc")
+
+// IsRunning reports whether a process named name is running, from the
+// command lines in /proc. It fails when /proc cannot be read.
+func IsRunning(name string) (bool, error) {
+	cmdlines, err := filepath.Glob("/proc/[0-9]*/cmdline")
+	if err != nil {
+		return false, err
+	}
+	if len(cmdlines) == 0 {
+		return false, errNoProc
+	}
+	for _, path := range cmdlines {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			// The process exited meanwhile.
+			continue
+		}
+		exe := strings.SplitN(string(buf), "\x00", 2)[0]
+		if exe != "" && filepath.Base(exe) == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
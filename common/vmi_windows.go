@@ -2,28 +2,29 @@ package common
 
 import (
 	"github.com/StackExchange/wmi"
-	"log"
 	"time"
 )
 
-func query() []Win32_Process {
+func query() ([]Win32_Process, error) {
 	var dst []Win32_Process
 	q := wmi.CreateQuery(&dst, "")
 	err := wmi.Query(q, &dst)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return dst
+	return dst, err
 }
 
-func IsRunning(name string) bool {
-	ps := query()
+// IsRunning reports whether a process named name is running. It fails
+// when the process list cannot be queried.
+func IsRunning(name string) (bool, error) {
+	ps, err := query()
+	if err != nil {
+		return false, err
+	}
 	for _, p := range ps {
 		if p.Name == name {
-			return true
+			return true, nil
 		}
 	}
-	return false
+	return false, nil
 }
 
 type Win32_Process struct {
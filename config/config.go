@@ -0,0 +1,593 @@
+// Package config loads the settings shared by the daemon, helper and
+// tokentest.
+//
+// Settings are resolved in this order, later sources winning: built-in
+// defaults, the config file, SIMPLEAUTH_<SECTION>_<KEY> environment
+// variables and command line flags.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/liuzhiyi/daemon/logging"
+	"gopkg.in/yaml.v2"
+)
+
+// Env names the config file when -config is not given.
+const Env = "SIMPLEAUTH_CONFIG"
+
+const envPrefix = "SIMPLEAUTH_"
+
+// Names searched for in the executable's folder when no file is named.
+var defaultNames = []string{"simpleauth.yaml", "simpleauth.yml", "simpleauth.json", "simpleauth.toml"}
+
+// IssuedCertValidity is how long the certificates the daemon issues
+// itself from its local CA are valid.
+const IssuedCertValidity = 90 * 24 * time.Hour
+
+// Duration is a time.Duration written as "90s" or "1h" in files.
+type Duration time.Duration
+
+func (d Duration) String() string { return time.Duration(d).String() }
+
+// Daemon holds the settings of the daemon.
+type Daemon struct {
+	Listen       string   `config:"listen"`
+	ServiceName  string   `config:"service-name"`
+	CachePath    string   `config:"cache-path"`
+	SessionTTL   Duration `config:"session-ttl"`
+	CacheCleanup Duration `config:"cache-cleanup"`
+	// TLSClientAuth is none, optional or require; client certificates
+	// are verified against TLSClientCA.
+	TLSClientAuth string `config:"tls-client-auth"`
+	TLSClientCA   string `config:"tls-client-ca"`
+	// MetricsListen is a separate address serving only /metrics, empty
+	// to serve none.
+	MetricsListen string `config:"metrics-listen,optional"`
+	// LogFile, when set, is written instead of the service manager's
+	// log while running as a service. It is rotated past LogMaxSize
+	// megabytes or LogMaxAge, keeping LogMaxBackups compressed files.
+	LogFile       string   `config:"log-file,optional"`
+	LogMaxSize    int      `config:"log-max-size"`
+	LogMaxAge     Duration `config:"log-max-age"`
+	LogMaxBackups int      `config:"log-max-backups"`
+	// TLS serves HTTPS, issuing a certificate from the local CA when
+	// none is configured.
+	TLS bool `config:"tls"`
+
+	// Settings below apply on reload without a restart.
+	TLSCert         string   `config:"tls-cert"`
+	TLSKey          string   `config:"tls-key"`
+	TLSCACert       string   `config:"tls-ca-cert"`
+	TLSCAKey        string   `config:"tls-ca-key"`
+	TLSHosts        string   `config:"tls-hosts"`
+	TLSRenewBefore  Duration `config:"tls-renew-before"`
+	LogLevel        string   `config:"log-level"`
+	LogFormat       string   `config:"log-format"`
+	AccessLogFormat string   `config:"access-log-format"`
+	RestartMode     string   `config:"restart-mode"`
+	DrainTimeout    Duration `config:"drain-timeout"`
+	CaptchaAfter    int      `config:"captcha-after"`
+	MaxBody         int      `config:"max-body"`
+	WatchInterval   Duration `config:"watch-interval"`
+	// MetricsToken, when set, is required as a bearer token on /metrics,
+	// which is then also served on the main listener.
+	MetricsToken string `config:"metrics-token,optional"`
+	// NewDevice2FA requires a one-time password for logins from new
+	// devices.
+	NewDevice2FA bool `config:"newdevice-2fa"`
+	// CorsOrigins are the comma separated origins allowed to call the
+	// API with cookies, * for any without them.
+	CorsOrigins string `config:"cors-origins,optional"`
+	// LoginURL is where /verify sends unauthenticated users.
+	LoginURL string `config:"login-url,optional"`
+	// DeprecatedVersions are the comma separated API versions marked
+	// deprecated, each optionally with a sunset date as 1.0@2027-01-31.
+	DeprecatedVersions string `config:"deprecated-versions,optional"`
+	// RPID and RPOrigin are the WebAuthn relying party ID and the origin
+	// allowed in client data.
+	RPID     string `config:"rp-id"`
+	RPOrigin string `config:"rp-origin"`
+	// AuditMaxBackups is how many rotated audit log files are kept, 0
+	// to keep all.
+	AuditMaxBackups int `config:"audit-max-backups"`
+}
+
+// Helper holds the settings of the update helper.
+type Helper struct {
+	ServiceName    string   `config:"service-name"`
+	UpdateURL      string   `config:"update-url"`
+	UpdateInterval Duration `config:"update-interval"`
+	Master         string   `config:"master"`
+	CheckInterval  Duration `config:"check-interval"`
+	LogLevel       string   `config:"log-level"`
+	LogFormat      string   `config:"log-format"`
+	LogFile        string   `config:"log-file,optional"`
+	LogMaxSize     int      `config:"log-max-size"`
+	LogMaxAge      Duration `config:"log-max-age"`
+	LogMaxBackups  int      `config:"log-max-backups"`
+}
+
+// Client holds the settings of tokentest.
+type Client struct {
+	ServiceName   string   `config:"service-name"`
+	Host          string   `config:"host"`
+	Helper        string   `config:"helper"`
+	CheckInterval Duration `config:"check-interval"`
+	LogLevel      string   `config:"log-level"`
+	LogFormat     string   `config:"log-format"`
+	LogFile       string   `config:"log-file,optional"`
+	LogMaxSize    int      `config:"log-max-size"`
+	LogMaxAge     Duration `config:"log-max-age"`
+	LogMaxBackups int      `config:"log-max-backups"`
+}
+
+// Config holds one section per binary.
+type Config struct {
+	Daemon Daemon `config:"daemon"`
+	Helper Helper `config:"helper"`
+	Client Client `config:"client"`
+
+	// File is the config file that was read, if any.
+	File string
+	// origins records where each setting came from.
+	origins map[string]string
+}
+
+// Default returns the built-in settings.
+func Default() *Config {
+	return &Config{
+		Daemon: Daemon{
+			Listen:        ":3000",
+			ServiceName:   "daemon",
+			CachePath:     "cache",
+			SessionTTL:    Duration(time.Hour),
+			CacheCleanup:  Duration(2 * time.Hour),
+			TLSClientAuth: "none",
+			TLSClientCA:   "ca.pem",
+			MetricsListen: "127.0.0.1:9100",
+			LogMaxSize:    100,
+			LogMaxAge:     Duration(24 * time.Hour),
+			LogMaxBackups: 7,
+
+			TLSCert:         "cert.pem",
+			TLSKey:          "key.pem",
+			TLSCACert:       "ca.pem",
+			TLSCAKey:        "ca-key.pem",
+			TLSHosts:        "localhost,127.0.0.1",
+			TLSRenewBefore:  Duration(30 * 24 * time.Hour),
+			LogLevel:        "info",
+			LogFormat:       "logfmt",
+			AccessLogFormat: "combined",
+			RestartMode:     "service",
+			DrainTimeout:    Duration(15 * time.Second),
+			CaptchaAfter:    3,
+			MaxBody:         64 << 10,
+			WatchInterval:   Duration(5 * time.Second),
+			RPID:            "localhost",
+			RPOrigin:        "http://localhost:3000",
+			AuditMaxBackups: 100,
+		},
+		Helper: Helper{
+			ServiceName:    "helper",
+			UpdateURL:      "http://127.0.0.1:3000",
+			UpdateInterval: Duration(time.Hour),
+			Master:         "tokentest.exe",
+			CheckInterval:  Duration(time.Minute),
+			LogLevel:       "info",
+			LogFormat:      "logfmt",
+			LogMaxSize:     100,
+			LogMaxAge:      Duration(24 * time.Hour),
+			LogMaxBackups:  7,
+		},
+		Client: Client{
+			ServiceName:   "tokentest",
+			Host:          "127.0.0.1:3000",
+			Helper:        "helper.exe",
+			CheckInterval: Duration(time.Minute),
+			LogLevel:      "info",
+			LogFormat:     "logfmt",
+			LogMaxSize:    100,
+			LogMaxAge:     Duration(24 * time.Hour),
+			LogMaxBackups: 7,
+		},
+		origins: make(map[string]string),
+	}
+}
+
+// Loader registers the flags of one section and loads the configuration
+// once they are parsed.
+type Loader struct {
+	section string
+	fs      *flag.FlagSet
+	file    *string
+	flags   map[string]*string
+}
+
+// NewLoader adds -config and a flag for every setting of section to fs.
+func NewLoader(fs *flag.FlagSet, section string) *Loader {
+	l := &Loader{
+		section: section,
+		fs:      fs,
+		file:    fs.String("config", "", "config file (YAML, JSON or TOML), default $"+Env+" or simpleauth.* next to the executable"),
+		flags:   make(map[string]*string),
+	}
+	defaults := Default()
+	for _, s := range defaults.settings() {
+		if s.section != section {
+			continue
+		}
+		usage := fmt.Sprintf("%s (default %v)", s.name(), s.value.Interface())
+		if _, ok := s.value.Interface().(bool); ok {
+			v := new(string)
+			fs.Var(boolFlag{v}, s.key, usage)
+			l.flags[s.key] = v
+			continue
+		}
+		l.flags[s.key] = fs.String(s.key, "", usage)
+	}
+	return l
+}
+
+// boolFlag is the flag of a bool setting, which may be given without a
+// value to turn it on.
+type boolFlag struct{ v *string }
+
+func (f boolFlag) String() string {
+	if f.v == nil {
+		return ""
+	}
+	return *f.v
+}
+
+func (f boolFlag) Set(v string) error {
+	*f.v = v
+	return nil
+}
+
+func (f boolFlag) IsBoolFlag() bool { return true }
+
+// Load resolves the configuration. It must be called after the flags
+// are parsed.
+func (l *Loader) Load() (*Config, error) {
+	c := Default()
+	path := *l.file
+	if path == "" {
+		path = os.Getenv(Env)
+	}
+	if path == "" {
+		path = find()
+	}
+	if path != "" {
+		if err := c.readFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.readEnv(); err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool)
+	l.fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, s := range c.settings() {
+		if s.section != l.section || !set[s.key] {
+			continue
+		}
+		if err := c.set(s, *l.flags[s.key], "flag -"+s.key); err != nil {
+			return nil, err
+		}
+	}
+	return c, c.Validate()
+}
+
+func find() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	for _, name := range defaultNames {
+		path := filepath.Join(filepath.Dir(exe), name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// readFile reads the sections of a YAML, JSON or TOML file, chosen by
+// its extension.
+func (c *Config) readFile(path string) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var sections map[string]map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(buf, &sections)
+	case ".json":
+		err = json.Unmarshal(buf, &sections)
+	case ".toml":
+		err = toml.Unmarshal(buf, &sections)
+	default:
+		return fmt.Errorf("%s: unknown config format", path)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	c.File = path
+	byName := make(map[string]setting)
+	for _, s := range c.settings() {
+		byName[s.name()] = s
+	}
+	var unknown []string
+	for section, values := range sections {
+		for key, v := range values {
+			s, ok := byName[section+"."+key]
+			if !ok {
+				unknown = append(unknown, section+"."+key)
+				continue
+			}
+			if err := c.set(s, fileValue(v), path); err != nil {
+				return err
+			}
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("%s: unknown settings %s", path, strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// fileValue formats a value decoded from a config file for set. JSON
+// decodes every number to a float, which is written out in full so that
+// integers parse.
+func fileValue(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			return strconv.FormatInt(int64(f), 10)
+		}
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+func (c *Config) readEnv() error {
+	for _, s := range c.settings() {
+		if v, ok := os.LookupEnv(s.env()); ok {
+			if err := c.set(s, v, "$"+s.env()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Validate reports every invalid setting.
+func (c *Config) Validate() error {
+	var errs []string
+	check := func(name string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	check("daemon.listen", checkAddr(c.Daemon.Listen))
+	if c.Daemon.MetricsListen != "" {
+		check("daemon.metrics-listen", checkAddr(c.Daemon.MetricsListen))
+	}
+	check("client.host", checkAddr(c.Client.Host))
+	check("helper.update-url", checkURL(c.Helper.UpdateURL))
+	for _, s := range c.settings() {
+		switch s.key {
+		case "log-level":
+			if _, err := logging.ParseLevel(s.value.String()); err != nil {
+				check(s.name(), errors.New("must be error, warning, info or debug"))
+			}
+		case "log-format":
+			if v := s.value.String(); v != "logfmt" && v != "json" {
+				check(s.name(), errors.New("must be logfmt or json"))
+			}
+		case "log-max-size":
+			if s.value.Int() < 0 {
+				check(s.name(), errors.New("must not be negative, 0 disables rotation by size"))
+			}
+		case "log-max-backups", "audit-max-backups":
+			if s.value.Int() < 0 {
+				check(s.name(), errors.New("must not be negative, 0 keeps every rotated file"))
+			}
+		}
+	}
+	if c.Daemon.AccessLogFormat != "combined" && c.Daemon.AccessLogFormat != "structured" {
+		check("daemon.access-log-format", errors.New("must be combined or structured"))
+	}
+	if c.Daemon.RestartMode != "service" && c.Daemon.RestartMode != "handoff" {
+		check("daemon.restart-mode", errors.New("must be service or handoff"))
+	}
+	switch c.Daemon.TLSClientAuth {
+	case "none", "optional", "require":
+	default:
+		check("daemon.tls-client-auth", errors.New("must be none, optional or require"))
+	}
+	if time.Duration(c.Daemon.TLSRenewBefore) >= IssuedCertValidity {
+		check("daemon.tls-renew-before", fmt.Errorf("must be less than %s, the validity of issued certificates", time.Duration(IssuedCertValidity)))
+	}
+	if c.Daemon.CaptchaAfter < 0 {
+		check("daemon.captcha-after", errors.New("must not be negative, 0 disables the captcha"))
+	}
+	if c.Daemon.MaxBody <= 0 {
+		check("daemon.max-body", errors.New("must be positive"))
+	}
+	for _, item := range strings.Split(c.Daemon.DeprecatedVersions, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "@", 2)
+		if len(parts) == 2 {
+			if _, err := time.Parse("2006-01-02", parts[1]); err != nil {
+				check("daemon.deprecated-versions", fmt.Errorf("bad sunset date %q of %s", parts[1], parts[0]))
+			}
+		}
+	}
+	if u, err := url.Parse(c.Daemon.RPOrigin); err != nil || u.Scheme == "" || u.Host == "" {
+		check("daemon.rp-origin", errors.New("must be an origin such as https://example.com"))
+	}
+	for _, s := range c.settings() {
+		switch v := s.value.Interface().(type) {
+		case string:
+			if v == "" && !s.optional {
+				check(s.name(), errors.New("must not be empty"))
+			}
+		case Duration:
+			if v <= 0 {
+				check(s.name(), errors.New("must be positive"))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+func checkAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("bad port %q", port)
+	}
+	return nil
+}
+
+func checkURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("must be an http or https URL")
+	}
+	return nil
+}
+
+// Check writes the settings of section and where each came from, and
+// returns the validation result. It backs the "config check" command.
+func (c *Config) Check(w io.Writer, section string) error {
+	if c.File != "" {
+		fmt.Fprintf(w, "config file: %s\n", c.File)
+	} else {
+		fmt.Fprintln(w, "config file: none")
+	}
+	for _, s := range c.settings() {
+		if s.section != section {
+			continue
+		}
+		origin := c.origins[s.name()]
+		if origin == "" {
+			origin = "default"
+		}
+		value := s.value.Interface()
+		if strings.HasSuffix(s.key, "-token") && value != "" {
+			value = "********"
+		}
+		fmt.Fprintf(w, "  %-24s %-24v %s\n", s.name(), value, origin)
+	}
+	return c.Validate()
+}
+
+// Rotation returns the rotation limits of a section's log file.
+func Rotation(maxSize int, maxAge Duration, maxBackups int) logging.Rotation {
+	return logging.Rotation{
+		MaxSize:    int64(maxSize) << 20,
+		MaxAge:     time.Duration(maxAge),
+		MaxBackups: maxBackups,
+	}
+}
+
+// Changed lists the settings of section that differ between c and next.
+func (c *Config) Changed(next *Config, section string) []string {
+	var changed []string
+	b := next.settings()
+	for i, s := range c.settings() {
+		if s.section == section && s.value.Interface() != b[i].value.Interface() {
+			changed = append(changed, s.name())
+		}
+	}
+	return changed
+}
+
+// setting is one field of a section. Optional string settings may be
+// empty.
+type setting struct {
+	section, key string
+	optional     bool
+	value        reflect.Value
+}
+
+func (s setting) name() string { return s.section + "." + s.key }
+
+func (s setting) env() string {
+	return envPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(s.name()))
+}
+
+func (c *Config) settings() []setting {
+	var all []setting
+	cv := reflect.ValueOf(c).Elem()
+	for i := 0; i < cv.NumField(); i++ {
+		section := cv.Type().Field(i).Tag.Get("config")
+		if section == "" {
+			continue
+		}
+		sv := cv.Field(i)
+		for j := 0; j < sv.NumField(); j++ {
+			tag := strings.Split(sv.Type().Field(j).Tag.Get("config"), ",")
+			optional := len(tag) > 1 && tag[1] == "optional"
+			all = append(all, setting{section, tag[0], optional, sv.Field(j)})
+		}
+	}
+	return all
+}
+
+// set parses v into s and records origin.
+func (c *Config) set(s setting, v, origin string) error {
+	switch s.value.Interface().(type) {
+	case string:
+		s.value.SetString(v)
+	case bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %v", origin, s.name(), err)
+		}
+		s.value.SetBool(b)
+	case int:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %v", origin, s.name(), err)
+		}
+		s.value.SetInt(int64(n))
+	case Duration:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %v", origin, s.name(), err)
+		}
+		s.value.Set(reflect.ValueOf(Duration(d)))
+	default:
+		panic("config: unsupported type of " + s.name())
+	}
+	c.origins[s.name()] = origin
+	return nil
+}
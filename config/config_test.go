@@ -0,0 +1,112 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// load loads the daemon section from a file named name holding content,
+// parsing args as the command line.
+func load(t *testing.T, name, content string, args ...string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	l := NewLoader(fs, "daemon")
+	if err := fs.Parse(append([]string{"-config", path}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	return l.Load()
+}
+
+func TestLoadFormats(t *testing.T) {
+	for _, test := range []struct {
+		name, content string
+	}{
+		{"simpleauth.yaml", "daemon:\n  max-body: 1048576\n  session-ttl: 90m\n  listen: \":4000\"\n"},
+		{"simpleauth.json", `{"daemon": {"max-body": 1048576, "session-ttl": "90m", "listen": ":4000"}}`},
+		{"simpleauth.toml", "[daemon]\nmax-body = 1048576\nsession-ttl = \"90m\"\nlisten = \":4000\"\n"},
+	} {
+		c, err := load(t, test.name, test.content)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if c.Daemon.MaxBody != 1048576 || c.Daemon.SessionTTL != Duration(90*time.Minute) || c.Daemon.Listen != ":4000" {
+			t.Errorf("%s: got %+v", test.name, c.Daemon)
+		}
+		if got := c.origins["daemon.max-body"]; got != c.File {
+			t.Errorf("%s: max-body from %q", test.name, got)
+		}
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	for _, test := range []struct {
+		name, content string
+	}{
+		{"fraction.json", `{"daemon": {"max-body": 1.5}}`},
+		{"unknown.json", `{"daemon": {"max-bodies": 1}}`},
+		{"invalid.yaml", "daemon:\n  max-body: 0\n"},
+		{"simpleauth.ini", "max-body = 1\n"},
+	} {
+		if _, err := load(t, test.name, test.content); err == nil {
+			t.Errorf("%s: loaded", test.name)
+		}
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	const file = "daemon:\n  max-body: 1000\n  captcha-after: 5\n  log-level: debug\n"
+	t.Setenv("SIMPLEAUTH_DAEMON_MAX_BODY", "2000")
+	t.Setenv("SIMPLEAUTH_DAEMON_CAPTCHA_AFTER", "6")
+	c, err := load(t, "simpleauth.yaml", file, "-max-body", "3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name   string
+		got    interface{}
+		want   interface{}
+		origin string
+	}{
+		{"daemon.max-body", c.Daemon.MaxBody, 3000, "flag -max-body"},
+		{"daemon.captcha-after", c.Daemon.CaptchaAfter, 6, "$SIMPLEAUTH_DAEMON_CAPTCHA_AFTER"},
+		{"daemon.log-level", c.Daemon.LogLevel, "debug", c.File},
+		{"daemon.log-format", c.Daemon.LogFormat, "logfmt", ""},
+	} {
+		if test.got != test.want {
+			t.Errorf("%s = %v, want %v", test.name, test.got, test.want)
+		}
+		if got := c.origins[test.name]; got != test.origin {
+			t.Errorf("%s from %q, want %q", test.name, got, test.origin)
+		}
+	}
+}
+
+func TestLoadBool(t *testing.T) {
+	for _, test := range []struct {
+		content string
+		args    []string
+		want    bool
+	}{
+		{"daemon:\n  tls: true\n", nil, true},
+		{"daemon:\n  tls: true\n", []string{"-tls=false"}, false},
+		{"daemon: {}\n", []string{"-tls"}, true},
+		{"daemon: {}\n", nil, false},
+	} {
+		c, err := load(t, "simpleauth.yaml", test.content, test.args...)
+		if err != nil {
+			t.Errorf("%q %v: %v", test.content, test.args, err)
+			continue
+		}
+		if c.Daemon.TLS != test.want {
+			t.Errorf("%q %v: tls %v", test.content, test.args, c.Daemon.TLS)
+		}
+	}
+}
@@ -9,13 +9,10 @@ package main
 
 HANDLE sema;
 
-void singleProc() {
+int singleProc() {
 
 	sema = CreateSemaphoreA(NULL, 1, 1, (LPCSTR)"flagSingle");
-	if (GetLastError() == 183) {
-		printf("进程已经运行");
-		exit(0);
-	}
+	return GetLastError() == 183;
 }
 */
 import "C"
@@ -27,7 +24,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"os/exec"
@@ -39,18 +35,27 @@ import (
 	"github.com/kardianos/osext"
 	"github.com/kardianos/service"
 	"github.com/liuzhiyi/daemon/common"
+	"github.com/liuzhiyi/daemon/config"
+	"github.com/liuzhiyi/daemon/logging"
 	"github.com/natefinch/npipe"
 )
 
 const (
 	currentVersion = "1.0"
-	master         = "tokentest.exe"
 )
 
 var (
-	logger      service.Logger
-	pConn       *npipe.PipeConn
-	versionData map[string]string
+	configLoader = config.NewLoader(flag.CommandLine, "helper")
+	cfg          = config.Default()
+	logger       = logging.New(os.Stderr)
+	pConn        *npipe.PipeConn
+	versionData  map[string]string
+
+	flCACert = flag.String("cacert", "", "trust only daemon certificates signed by this CA")
+	flCert   = flag.String("cert", "", "client certificate to authenticate to the daemon with")
+	flKey    = flag.String("key", "", "private key of the client certificate")
+	// client fetches versions and updates, with the TLS settings above.
+	client = http.DefaultClient
 )
 
 type program struct {
@@ -73,7 +78,7 @@ func (p *program) Start(s service.Service) error {
 }
 
 func (p *program) run(s service.Service) error {
-	logger.Info("启动中....")
+	logger.Info(tr("starting"))
 	//检测更新
 	checkUpdate()
 	//监测主程
@@ -85,15 +90,45 @@ func (p *program) run(s service.Service) error {
 
 func main() {
 	defer C.CloseHandle(C.sema)
-	C.singleProc()
+	flag.Parse()
+	lang = common.Locale(*flLocale, common.LangZH)
+	args := flag.Args()
+
+	var err error
+	cfg, err = configLoader.Load()
+	if len(args) == 2 && args[0] == "config" && args[1] == "check" {
+		if cfg != nil {
+			err = cfg.Check(os.Stdout, "helper")
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err != nil {
+		logger.Fatal(err)
+	}
+	logger.SetLevel(cfg.Helper.LogLevel)
+	logger.SetFormat(cfg.Helper.LogFormat)
+	if *flCACert != "" || *flCert != "" {
+		tlsConfig, err := common.ClientTLSConfig(*flCACert, *flCert, *flKey)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		client = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	}
+	if C.singleProc() != 0 {
+		fmt.Print(tr("already_running"))
+		os.Exit(0)
+	}
 	// // hd, err := common.CreateSema(0, 1, syscall.StringToUTF16Ptr("streamSemaphore"))
 	// // if err != nil {
 	// // 	fmt.Println(err.Error)
 	// // }
 	// defer syscall.Close(hd)
-	flag.Parse()
 	svcConfig := &service.Config{
-		Name:        "helper",
+		Name:        cfg.Helper.ServiceName,
 		DisplayName: "Update Service",
 		Description: "This is a helper Go service.",
 	}
@@ -101,37 +136,42 @@ func main() {
 	prg := &program{}
 	s, err := service.New(prg, svcConfig)
 	if err != nil {
-		log.Fatal(err.Error())
+		logger.Fatal(err.Error())
 	}
 	errs := make(chan error, 5)
-	logger, err = s.Logger(errs)
+	svcLogger, err := s.Logger(errs)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err)
+	}
+	if !service.Interactive() {
+		// Log to the log file when one is set, else to the service
+		// manager.
+		c := cfg.Helper
+		defer logger.ServiceOutput(svcLogger, c.LogFile, config.Rotation(c.LogMaxSize, c.LogMaxAge, c.LogMaxBackups)).Close()
 	}
 
 	go func() {
 		for {
 			err := <-errs
 			if err != nil {
-				log.Print(err)
+				// Not through logger, which would forward it again.
+				fmt.Fprintln(os.Stderr, err)
 			}
 		}
 	}()
 
-	args := flag.Args()
 	if len(args) == 1 {
 		err := service.Control(s, args[0])
 		if err != nil {
 			if args[0] == service.ControlAction[0] {
-				fmt.Println(args[0])
 				s.Install()
 				s.Start()
 			} else if args[0] == service.ControlAction[1] {
 				s.Install()
 				s.Stop()
 			} else {
-				log.Printf("Valid actions: %q\n", service.ControlAction)
-				log.Fatal(err)
+				logger.Errorf("valid actions: %q", service.ControlAction)
+				logger.Fatal(err)
 			}
 		}
 		return
@@ -144,20 +184,25 @@ func main() {
 }
 
 func setTimer() {
-	common.Timer(60*60*time.Second, checkUpdate)
-	common.Timer(60*time.Second, checkMaster)
+	common.Timer(time.Duration(cfg.Helper.UpdateInterval), checkUpdate)
+	common.Timer(time.Duration(cfg.Helper.CheckInterval), checkMaster)
 }
 
 func checkUpdate() {
 	if compareVersion(getLatestVersion(),
 		getLocalVersion()) > 0 {
 		updateVersion()
-		logger.Info("版本更新完成")
+		logger.Info(tr("updated"))
 	}
 }
 
 func checkMaster() {
-	if !common.IsRunning(master) {
+	running, err := common.IsRunning(cfg.Helper.Master)
+	if err != nil {
+		logger.Errorf("wmi:%s", err.Error())
+		return
+	}
+	if !running {
 		err := startMaster()
 		if err != nil {
 			logger.Info(err.Error())
@@ -183,10 +228,10 @@ func createPipeConn() {
 	for tries > 0 {
 		pConn, err = npipe.DialTimeout(common.PipeAddr, 5*time.Second)
 		if err != nil {
-			log.Print(err.Error())
+			logger.Error(err.Error())
 			err = startMaster()
 			if err != nil {
-				log.Fatal(err.Error())
+				logger.Fatal(err.Error())
 			}
 			tries = 1
 		} else {
@@ -195,12 +240,12 @@ func createPipeConn() {
 		tries--
 	}
 	if pConn == nil {
-		log.Fatal("the program has an fatal error")
+		logger.Fatal("the program has an fatal error")
 	}
 }
 
 func startMaster() error {
-	cmd := exec.Command(master, "start")
+	cmd := exec.Command(cfg.Helper.Master, "start")
 	binPath, _ := osext.ExecutableFolder()
 	logger.Info(binPath)
 	cmd.Dir = binPath
@@ -208,7 +253,7 @@ func startMaster() error {
 }
 
 func stopMaster() error {
-	cmd := exec.Command(master, "stop")
+	cmd := exec.Command(cfg.Helper.Master, "stop")
 	cmd.Dir, _ = osext.ExecutableFolder()
 	return cmd.Start()
 }
@@ -219,17 +264,17 @@ func unzip(name string) error {
 
 func updateVersion() {
 	stopMaster()
-	exec.Command(master, "uninstall").Start()
+	exec.Command(cfg.Helper.Master, "uninstall").Start()
 
 	binPath, _ := osext.ExecutableFolder()
 	//rename master
-	oldMaster := fmt.Sprintf("%s.old", master)
-	os.Rename(path.Join(binPath, master), oldMaster)
+	oldMaster := fmt.Sprintf("%s.old", cfg.Helper.Master)
+	os.Rename(path.Join(binPath, cfg.Helper.Master), oldMaster)
 
 	//download
 	version := versionData["version"]
 	build := versionData["build"]
-	url := fmt.Sprintf("http://127.0.0.1:3000/v%s/file/%s/%s", version, build, master)
+	url := fmt.Sprintf("%s/v%s/file/%s/%s", strings.TrimRight(cfg.Helper.UpdateURL, "/"), version, build, cfg.Helper.Master)
 	downloadFromUrl(url)
 
 	//unzip
@@ -252,17 +297,17 @@ func processResult(rsp *http.Response) (rel map[string]string) {
 	str, err := ioutil.ReadAll(rsp.Body)
 	err = json.Unmarshal(str, &rel)
 	if err != nil {
-		fmt.Println(err.Error())
+		logger.Error(err.Error())
 	}
 	return
 }
 
 func getLatestVersion() string {
-	rsp, err := http.Get("http://127.0.0.1:3000/v1.0/version")
+	rsp, err := client.Get(strings.TrimRight(cfg.Helper.UpdateURL, "/") + "/v1.0/version")
 	if err == nil {
 		data := processResult(rsp)
 		if build, ok := data["build"]; ok {
-			fmt.Println(build)
+			logger.Infof("latest build %s", build)
 			versionData = data
 			return build
 		}
@@ -274,28 +319,28 @@ func getLatestVersion() string {
 func downloadFromUrl(url string) {
 	tokens := strings.Split(url, "/")
 	fileName := tokens[len(tokens)-1]
-	fmt.Println("Downloading", url, "to", fileName)
+	logger.Infof("downloading %s to %s", url, fileName)
 
 	// TODO: check file existence first with io.IsExist
 	output, err := os.Create(fileName)
 	if err != nil {
-		fmt.Println("Error while creating", fileName, "-", err)
+		logger.Errorf("creating %s:%s", fileName, err.Error())
 		return
 	}
 	defer output.Close()
 
-	response, err := http.Get(url)
+	response, err := client.Get(url)
 	if err != nil {
-		fmt.Println("Error while downloading", url, "-", err)
+		logger.Errorf("downloading %s:%s", url, err.Error())
 		return
 	}
 	defer response.Body.Close()
 
 	n, err := io.Copy(output, response.Body)
 	if err != nil {
-		fmt.Println("Error while downloading", url, "-", err)
+		logger.Errorf("downloading %s:%s", url, err.Error())
 		return
 	}
 
-	fmt.Println(n, "bytes downloaded.")
+	logger.Infof("%d bytes downloaded", n)
 }
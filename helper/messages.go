@@ -0,0 +1,31 @@
+// +build windows
+
+package main
+
+import (
+	"flag"
+
+	"github.com/liuzhiyi/daemon/common"
+)
+
+var flLocale = flag.String("locale", "", "message language, zh-CN or en (default $SIMPLEAUTH_LOCALE or $LANG)")
+
+// lang is the language of the helper's output, set once flags are parsed.
+var lang = common.LangZH
+
+var messages = common.Messages{
+	common.LangZH: {
+		"already_running": "进程已经运行",
+		"starting":        "启动中....",
+		"updated":         "版本更新完成",
+	},
+	common.LangEN: {
+		"already_running": "already running",
+		"starting":        "starting....",
+		"updated":         "update finished",
+	},
+}
+
+func tr(key string) string {
+	return messages.Get(lang, key)
+}
@@ -0,0 +1,279 @@
+package logging
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatedFormat is the time of rotation appended to the names of rotated
+// files. It sorts in time order.
+const rotatedFormat = "20060102T150405.000000000"
+
+var errClosed = errors.New("log file closed")
+
+// Rotation limits a log file and the rotated files kept.
+type Rotation struct {
+	// MaxSize is the size in bytes past which the file is rotated, 0
+	// for no limit.
+	MaxSize int64
+	// MaxAge is the age past which the file is rotated, 0 for no limit.
+	MaxAge time.Duration
+	// MaxBackups is the number of rotated files kept, 0 to keep all.
+	MaxBackups int
+}
+
+// File appends to a log file, rotating it as limited by its Rotation.
+// A rotated file is renamed to path.<time>, then compressed to
+// path.<time>.gz in the background, and the oldest are removed beyond
+// MaxBackups.
+type File struct {
+	path     string
+	rotation Rotation
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	started time.Time
+	closed  bool
+
+	// gzMu serializes compressing and pruning; pending waits for them.
+	gzMu    sync.Mutex
+	pending sync.WaitGroup
+}
+
+// OpenFile opens path for appending, creating it and its folder as
+// needed. Rotated files left uncompressed by a previous process are
+// compressed.
+func OpenFile(path string, r Rotation) (*File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f := &File{path: path, rotation: r}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	// The file was started when the last one was rotated. Without a
+	// rotated file its age is unknown and counted from now.
+	if rotated, err := f.rotated(); err == nil && len(rotated) > 0 && f.size > 0 {
+		f.started = rotated[len(rotated)-1].at
+	}
+	f.cleanup()
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.started = time.Now()
+	return nil
+}
+
+// Write appends p, rotating first when p would take the file past
+// MaxSize or the file is older than MaxAge. A line is never split
+// across files.
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, errClosed
+	}
+	if f.file == nil {
+		// Reopen after a failed rotation.
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.size > 0 && f.due(int64(len(p))) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *File) due(n int64) bool {
+	r := f.rotation
+	if r.MaxSize > 0 && f.size+n > r.MaxSize {
+		return true
+	}
+	return r.MaxAge > 0 && time.Since(f.started) > r.MaxAge
+}
+
+func (f *File) rotate() error {
+	err := f.file.Close()
+	f.file = nil
+	if err != nil {
+		return err
+	}
+	rotated := f.path + "." + time.Now().UTC().Format(rotatedFormat)
+	if err := os.Rename(f.path, rotated); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.cleanup()
+	return nil
+}
+
+// Close closes the file and waits for rotated files to be compressed.
+func (f *File) Close() error {
+	f.mu.Lock()
+	f.closed = true
+	var err error
+	if f.file != nil {
+		err = f.file.Close()
+		f.file = nil
+	}
+	f.mu.Unlock()
+	f.pending.Wait()
+	return err
+}
+
+// ServiceOutput sends the lines of l, when run by a service manager, to
+// the log file at path, rotated as limited by r, or to svc, the service
+// manager's logger, when path is empty or the file cannot be opened.
+// Close the returned closer on exit.
+func (l *Logger) ServiceOutput(svc Forwarder, path string, r Rotation) io.Closer {
+	l.SetOutput(nil)
+	l.Forward(svc)
+	if path == "" {
+		return nopCloser{}
+	}
+	f, err := OpenFile(path, r)
+	if err != nil {
+		l.Errorf("log file:%s", err.Error())
+		return nopCloser{}
+	}
+	l.Forward(nil)
+	l.SetOutput(f)
+	return f
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// cleanup compresses the rotated files and removes the oldest in the
+// background. Errors go to stderr, as the file may be the only log.
+func (f *File) cleanup() {
+	f.pending.Add(1)
+	go func() {
+		defer f.pending.Done()
+		f.gzMu.Lock()
+		defer f.gzMu.Unlock()
+		if err := f.compressAndPrune(); err != nil {
+			fmt.Fprintf(os.Stderr, "log file %s: %v\n", f.path, err)
+		}
+	}()
+}
+
+func (f *File) compressAndPrune() error {
+	rotated, err := f.rotated()
+	if err != nil {
+		return err
+	}
+	for _, r := range rotated {
+		if !strings.HasSuffix(r.name, ".gz") {
+			if err := compress(r.name); err != nil {
+				return err
+			}
+		}
+	}
+	if max := f.rotation.MaxBackups; max > 0 && len(rotated) > max {
+		for _, r := range rotated[:len(rotated)-max] {
+			name := r.name
+			if !strings.HasSuffix(name, ".gz") {
+				name += ".gz"
+			}
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type rotatedFile struct {
+	name string
+	at   time.Time
+}
+
+// rotated returns the rotated files, compressed or not, oldest first.
+// When compressing was interrupted, the uncompressed file is returned.
+// Other files sharing the prefix are ignored.
+func (f *File) rotated() ([]rotatedFile, error) {
+	names, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	byStamp := make(map[string]rotatedFile)
+	for _, name := range names {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, f.path+"."), ".gz")
+		at, err := time.Parse(rotatedFormat, stamp)
+		if err != nil {
+			continue
+		}
+		if _, ok := byStamp[stamp]; !ok || !strings.HasSuffix(name, ".gz") {
+			byStamp[stamp] = rotatedFile{name, at}
+		}
+	}
+	rotated := make([]rotatedFile, 0, len(byStamp))
+	for _, r := range byStamp {
+		rotated = append(rotated, r)
+	}
+	sort.Slice(rotated, func(i, j int) bool { return rotated[i].at.Before(rotated[j].at) })
+	return rotated, nil
+}
+
+// compress replaces name with name.gz. A partial name.gz left by a
+// failure is removed.
+func compress(name string) (err error) {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(name + ".gz")
+		}
+	}()
+	zw := gzip.NewWriter(out)
+	zw.Name = filepath.Base(name)
+	_, err = io.Copy(zw, in)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	in.Close()
+	return os.Remove(name)
+}
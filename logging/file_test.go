@@ -0,0 +1,129 @@
+package logging
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readRotated returns the contents of the compressed rotated files of
+// path, oldest first.
+func readRotated(t *testing.T, path string) []string {
+	t.Helper()
+	names, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents []string
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".gz") {
+			t.Fatalf("%s not compressed", name)
+		}
+		file, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, string(data))
+	}
+	return contents
+}
+
+func TestFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "daemon.log")
+	f, err := OpenFile(path, Rotation{MaxSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third line\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each line went past MaxSize, so each started a file and none was
+	// split.
+	got := readRotated(t, path)
+	if len(got) != 2 || got[0] != "first\n" || got[1] != "second\n" {
+		t.Errorf("rotated files %q", got)
+	}
+	current, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(current) != "third line\n" {
+		t.Errorf("log file %q", current)
+	}
+}
+
+func TestFileMaxBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "daemon.log")
+	f, err := OpenFile(path, Rotation{MaxSize: 1, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"1\n", "2\n", "3\n", "4\n", "5\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The oldest rotated files are removed.
+	got := readRotated(t, path)
+	if len(got) != 2 || got[0] != "3\n" || got[1] != "4\n" {
+		t.Errorf("rotated files %q", got)
+	}
+}
+
+func TestFileCompressesLeftover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "daemon.log")
+	// A rotated file a previous process did not get to compress.
+	if err := ioutil.WriteFile(path+".20200102T030405.000000000", []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenFile(path, Rotation{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readRotated(t, path); len(got) != 1 || got[0] != "old\n" {
+		t.Errorf("rotated files %q", got)
+	}
+}
+
+func TestServiceOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "daemon.log")
+	l := New(ioutil.Discard)
+	c := l.ServiceOutput(nil, path, Rotation{})
+	l.Info("to the file")
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "to the file") {
+		t.Errorf("log file %q", data)
+	}
+}
@@ -0,0 +1,236 @@
+// Package logging writes leveled, structured log lines for the daemon,
+// helper and tokentest.
+//
+// A line carries the time, level and message followed by the fields of
+// the logger, such as component=realm or request_id=..., formatted as
+// logfmt or JSON. Lines are written to an output and forwarded to the
+// service manager's logger, either of which may be unset.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a line.
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warning
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warning", "error"}
+
+func (l Level) String() string { return levelNames[l] }
+
+// ParseLevel returns the level named by s.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if s == name {
+			return Level(i), nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %q", s)
+}
+
+// Forwarder receives every line written, without the time. The
+// service.Logger of kardianos/service satisfies it.
+type Forwarder interface {
+	Error(v ...interface{}) error
+	Warning(v ...interface{}) error
+	Info(v ...interface{}) error
+}
+
+// sink is shared by a logger and every logger derived from it with With,
+// so that settings changed on one apply to all.
+type sink struct {
+	mu      sync.Mutex
+	out     io.Writer
+	json    bool
+	level   Level
+	forward Forwarder
+}
+
+// Logger writes lines with a fixed set of fields. It implements
+// service.Logger, so it can stand in wherever one is expected.
+type Logger struct {
+	sink   *sink
+	fields []interface{}
+}
+
+// New returns a logger writing logfmt lines of level info and above to
+// out.
+func New(out io.Writer) *Logger {
+	return &Logger{sink: &sink{out: out, level: Info}}
+}
+
+// SetOutput replaces the output; nil writes nothing but still forwards.
+func (l *Logger) SetOutput(out io.Writer) {
+	l.sink.mu.Lock()
+	l.sink.out = out
+	l.sink.mu.Unlock()
+}
+
+// SetFormat selects "logfmt" or "json" lines.
+func (l *Logger) SetFormat(format string) error {
+	if format != "logfmt" && format != "json" {
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	l.sink.mu.Lock()
+	l.sink.json = format == "json"
+	l.sink.mu.Unlock()
+	return nil
+}
+
+// SetLevel drops lines below the named level.
+func (l *Logger) SetLevel(name string) error {
+	level, err := ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	l.sink.mu.Lock()
+	l.sink.level = level
+	l.sink.mu.Unlock()
+	return nil
+}
+
+// Forward sends every line to f as well.
+func (l *Logger) Forward(f Forwarder) {
+	l.sink.mu.Lock()
+	l.sink.forward = f
+	l.sink.mu.Unlock()
+}
+
+// With returns a logger that adds the given key, value pairs to every
+// line.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{sink: l.sink, fields: fields}
+}
+
+// Log writes msg at level with the logger's fields and kv.
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) {
+	s := l.sink
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if level < s.level {
+		return
+	}
+	fields := append(append([]interface{}{"level", level.String(), "msg", msg}, l.fields...), kv...)
+	if s.out != nil {
+		s.out.Write(s.format(append([]interface{}{"time", time.Now().Format(time.RFC3339Nano)}, fields...)))
+	}
+	if s.forward != nil {
+		line := strings.TrimSuffix(string(s.format(fields)), "\n")
+		switch level {
+		case Error:
+			s.forward.Error(line)
+		case Warning:
+			s.forward.Warning(line)
+		default:
+			s.forward.Info(line)
+		}
+	}
+}
+
+func (s *sink) format(kv []interface{}) []byte {
+	var buf bytes.Buffer
+	if s.json {
+		buf.WriteByte('{')
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, value := fmt.Sprint(kv[i]), kv[i+1]
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		if s.json {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			k, _ := json.Marshal(key)
+			v, err := json.Marshal(value)
+			if err != nil {
+				v, _ = json.Marshal(fmt.Sprint(value))
+			}
+			buf.Write(k)
+			buf.WriteByte(':')
+			buf.Write(v)
+			continue
+		}
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		buf.WriteString(logfmtValue(fmt.Sprint(value)))
+	}
+	if s.json {
+		buf.WriteByte('}')
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// logfmtValue quotes v when it is empty or holds spaces, quotes, equals
+// signs or control characters.
+func logfmtValue(v string) string {
+	if v == "" || strings.IndexFunc(v, func(r rune) bool {
+		return r <= ' ' || r == '"' || r == '=' || r == 0x7f
+	}) >= 0 {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+func (l *Logger) Debugf(format string, a ...interface{}) error {
+	l.Log(Debug, fmt.Sprintf(format, a...))
+	return nil
+}
+
+func (l *Logger) Info(v ...interface{}) error {
+	l.Log(Info, fmt.Sprint(v...))
+	return nil
+}
+
+func (l *Logger) Infof(format string, a ...interface{}) error {
+	l.Log(Info, fmt.Sprintf(format, a...))
+	return nil
+}
+
+func (l *Logger) Warning(v ...interface{}) error {
+	l.Log(Warning, fmt.Sprint(v...))
+	return nil
+}
+
+func (l *Logger) Warningf(format string, a ...interface{}) error {
+	l.Log(Warning, fmt.Sprintf(format, a...))
+	return nil
+}
+
+func (l *Logger) Error(v ...interface{}) error {
+	l.Log(Error, fmt.Sprint(v...))
+	return nil
+}
+
+func (l *Logger) Errorf(format string, a ...interface{}) error {
+	l.Log(Error, fmt.Sprintf(format, a...))
+	return nil
+}
+
+// Fatal logs v as an error and exits.
+func (l *Logger) Fatal(v ...interface{}) {
+	l.Log(Error, fmt.Sprint(v...))
+	os.Exit(1)
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kardianos/service"
+)
+
+var auditLogger = logger.With("component", "audit")
+
+const (
+	auditPath          = "/audit/audit.log"
+	auditMaxSize int64 = 10 * 1024 * 1024
+
+	auditLogin         = "login"
+	auditLoginFailed   = "login.failed"
+	auditLogout        = "logout"
+	auditRestart       = "service.restart"
+	auditSessionRevoke = "session.revoke"
+	auditUserCreate    = "user.create"
+	auditUserUpdate    = "user.update"
+	auditUserDelete    = "user.delete"
+
+	// auditSystem is the actor of events the daemon causes itself, such
+	// as applying realms.json.
+	auditSystem = "system"
+
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+)
+
+var audit *auditLog
+
+// auditRecord is one line of the audit log. Hash covers the record with
+// Hash left empty, and PrevHash links it to the record written before it.
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Realm     string    `json:"realm,omitempty"`
+	Actor     string    `json:"actor"`
+	RemoteIP  string    `json:"remote_ip"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target,omitempty"`
+	Outcome   string    `json:"outcome"`
+	RequestID string    `json:"request_id,omitempty"`
+	PrevHash  string    `json:"prev_hash"`
+	Hash      string    `json:"hash"`
+}
+
+func (r auditRecord) digest() string {
+	r.Hash = ""
+	buf, _ := json.Marshal(r)
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditLog appends hash chained JSON Lines records to a file, rotating it
+// once it grows past maxSize. The chain continues across rotated files.
+// Beyond audit-max-backups rotated files the oldest are removed, and the
+// anchor file keeps the hash the first record left must link to.
+type auditLog struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	file     *os.File
+	size     int64
+	lastHash string
+}
+
+func newAuditLog(path string, maxSize int64) (*auditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	a := &auditLog{path: path, maxSize: maxSize}
+	files, err := a.files()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(files) - 1; i >= 0 && a.lastHash == ""; i-- {
+		records, err := readAuditFile(files[i])
+		if err != nil {
+			return nil, err
+		}
+		if len(records) > 0 {
+			a.lastHash = records[len(records)-1].Hash
+		}
+	}
+	if a.lastHash == "" {
+		if a.lastHash, err = a.anchor(); err != nil {
+			return nil, err
+		}
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+// rotate renames the current file and starts a new one, then prunes the
+// rotated files. When the file cannot be renamed, as on Windows while a
+// query reads it, the current file is kept and rotation is tried again on
+// the next write.
+func (a *auditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%s", a.path, time.Now().UTC().Format(rotatedFormat))
+	if err := os.Rename(a.path, rotated); err != nil {
+		auditLogger.Warningf("audit log rotation:%s", err.Error())
+		return a.open()
+	}
+	if err := a.open(); err != nil {
+		return err
+	}
+	if err := a.prune(liveConfig().Daemon.AuditMaxBackups); err != nil {
+		auditLogger.Errorf("audit log pruning:%s", err.Error())
+	}
+	return nil
+}
+
+const rotatedFormat = "20060102T150405.000000000"
+
+// prune removes the oldest rotated files beyond maxBackups, 0 keeping
+// all, after moving the anchor to the last record removed.
+func (a *auditLog) prune(maxBackups int) error {
+	files, err := a.files()
+	if err != nil || maxBackups <= 0 {
+		return err
+	}
+	rotated := files[:len(files)-1]
+	if len(rotated) <= maxBackups {
+		return nil
+	}
+	removed := rotated[:len(rotated)-maxBackups]
+	anchor, err := a.anchor()
+	if err != nil {
+		return err
+	}
+	for _, name := range removed {
+		records, err := readAuditFile(name)
+		if err != nil {
+			return err
+		}
+		if len(records) > 0 {
+			anchor = records[len(records)-1].Hash
+		}
+	}
+	tmp := a.anchorPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(anchor), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, a.anchorPath()); err != nil {
+		return err
+	}
+	for _, name := range removed {
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+		auditLogger.Infof("audit log %s removed", filepath.Base(name))
+	}
+	return nil
+}
+
+func (a *auditLog) anchorPath() string {
+	return a.path + ".anchor"
+}
+
+// anchor returns the hash the oldest record kept links to, empty when no
+// file was ever pruned.
+func (a *auditLog) anchor() (string, error) {
+	buf, err := ioutil.ReadFile(a.anchorPath())
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(buf)), err
+}
+
+// files returns the rotated files oldest first, followed by the current one.
+func (a *auditLog) files() ([]string, error) {
+	matches, err := filepath.Glob(a.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var rotated []string
+	for _, name := range matches {
+		stamp := strings.TrimPrefix(name, a.path+".")
+		if _, err := time.Parse(rotatedFormat, stamp); err == nil {
+			rotated = append(rotated, name)
+		}
+	}
+	sort.Strings(rotated)
+	if _, err := os.Stat(a.path); err == nil {
+		rotated = append(rotated, a.path)
+	}
+	return rotated, nil
+}
+
+var errAuditClosed = errors.New("audit log closed")
+
+// close closes the log. Records added later are dropped and reported.
+func (a *auditLog) close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+func (a *auditLog) write(rec auditRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return errAuditClosed
+	}
+	rec.PrevHash = a.lastHash
+	rec.Hash = rec.digest()
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		return err
+	}
+	a.lastHash = rec.Hash
+	return nil
+}
+
+// record writes a security event for req. It is safe to call when the
+// audit log could not be opened.
+func (a *auditLog) record(req *http.Request, actor, action, target, outcome string) {
+	a.add(auditRecord{
+		Realm:     realmOf(req).name,
+		Actor:     actor,
+		RemoteIP:  remoteIP(req),
+		Action:    action,
+		Target:    target,
+		Outcome:   outcome,
+		RequestID: requestID(req),
+	})
+}
+
+// recordSystem writes a security event the daemon caused itself rather
+// than a request, in realm.
+func (a *auditLog) recordSystem(realm, action, target, outcome string) {
+	a.add(auditRecord{
+		Realm:   realm,
+		Actor:   auditSystem,
+		Action:  action,
+		Target:  target,
+		Outcome: outcome,
+	})
+}
+
+func (a *auditLog) add(rec auditRecord) {
+	if a == nil {
+		return
+	}
+	rec.Time = time.Now().UTC()
+	if err := a.write(rec); err != nil {
+		auditLogger.Errorf("audit write failed:%s", err.Error())
+	}
+}
+
+type auditFilter struct {
+	from   time.Time
+	to     time.Time
+	realm  string
+	actor  string
+	action string
+}
+
+func (f auditFilter) match(rec auditRecord) bool {
+	if !f.from.IsZero() && rec.Time.Before(f.from) {
+		return false
+	}
+	if !f.to.IsZero() && rec.Time.After(f.to) {
+		return false
+	}
+	if f.realm != "" {
+		realm := rec.Realm
+		if realm == "" {
+			realm = defaultRealmName
+		}
+		if realm != f.realm {
+			return false
+		}
+	}
+	if f.actor != "" && rec.Actor != f.actor {
+		return false
+	}
+	if f.action != "" && rec.Action != f.action {
+		return false
+	}
+	return true
+}
+
+var errAuditChain = errors.New("audit chain broken")
+
+// query returns the records matching filter and verifies the whole chain
+// while reading it. Only opening the files holds up writers: the current
+// file is read up to its size at that time, and on Unix files rotated or
+// pruned meanwhile stay readable through the open handles.
+func (a *auditLog) query(filter auditFilter) ([]auditRecord, error) {
+	files, anchor, err := a.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var (
+		matched  []auditRecord
+		prevHash = anchor
+		chainErr error
+	)
+	for _, f := range files {
+		records, err := readAuditRecords(f.reader, f.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, rec := range records {
+			if chainErr == nil && (rec.PrevHash != prevHash || rec.Hash != rec.digest()) {
+				chainErr = fmt.Errorf("%w at %s %s", errAuditChain, f.name, rec.Time.Format(time.RFC3339Nano))
+			}
+			prevHash = rec.Hash
+			if filter.match(rec) {
+				matched = append(matched, rec)
+			}
+		}
+	}
+	return matched, chainErr
+}
+
+// auditFile is a file of the log opened by snapshot.
+type auditFile struct {
+	*os.File
+	name   string
+	reader io.Reader
+}
+
+// snapshot opens the files of the log, oldest first, and reads the
+// anchor, under the lock.
+func (a *auditLog) snapshot() ([]auditFile, string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	names, err := a.files()
+	if err != nil {
+		return nil, "", err
+	}
+	anchor, err := a.anchor()
+	if err != nil {
+		return nil, "", err
+	}
+	var files []auditFile
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			for _, opened := range files {
+				opened.Close()
+			}
+			return nil, "", err
+		}
+		var r io.Reader = f
+		if name == a.path {
+			r = io.LimitReader(f, a.size)
+		}
+		files = append(files, auditFile{f, name, r})
+	}
+	return files, anchor, nil
+}
+
+func readAuditFile(name string) ([]auditRecord, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readAuditRecords(f, name)
+}
+
+func readAuditRecords(r io.Reader, name string) ([]auditRecord, error) {
+	var records []auditRecord
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func openAudit() {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = "./"
+	}
+	audit, err = newAuditLog(filepath.Join(dir, auditPath), auditMaxSize)
+	if err != nil {
+		auditLogger.Errorf("audit log disabled:%s", err.Error())
+	}
+}
+
+func AuditQuery(s service.Service, w http.ResponseWriter, req *http.Request, session *Session) {
+	var data Rsp
+	query := req.URL.Query()
+	filter := auditFilter{realm: realmOf(req).name, actor: query.Get("actor"), action: query.Get("action")}
+	var err error
+	if v := query.Get("from"); v != "" {
+		if filter.from, err = time.Parse(time.RFC3339, v); err != nil {
+			writeError(w, req, errBadParams, nil)
+			return
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		if filter.to, err = time.Parse(time.RFC3339, v); err != nil {
+			writeError(w, req, errBadParams, nil)
+			return
+		}
+	}
+	if audit == nil {
+		writeError(w, req, errSystem, nil)
+		return
+	}
+	records, err := audit.query(filter)
+	result := map[string]interface{}{
+		"records": records,
+		"intact":  err == nil,
+	}
+	if err != nil {
+		if !errors.Is(err, errAuditChain) {
+			requestLogger(req).Error(err.Error())
+			writeError(w, req, errSystem, nil)
+			return
+		}
+		requestLogger(req).Error(err.Error())
+		result["error"] = err.Error()
+	}
+	data.Code = "200"
+	data.Object = result
+	output(w, data)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAudit opens an audit log in a temporary directory, rotating past
+// maxSize bytes.
+func newTestAudit(t *testing.T, maxSize int64) *auditLog {
+	t.Helper()
+	a, err := newAuditLog(filepath.Join(t.TempDir(), "audit.log"), maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.close() })
+	return a
+}
+
+func TestAuditTampered(t *testing.T) {
+	srv := newTestServer(t)
+	token, _ := login(t, newClient(t), srv.URL).Object["token"].(string)
+	if rsp := getWithToken(t, srv.URL+"/v1.0/audit", token); rsp.Object["intact"] != true {
+		t.Fatalf("before editing: %+v", rsp)
+	}
+
+	buf, err := ioutil.ReadFile(audit.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := strings.Replace(string(buf), `"actor":"admin"`, `"actor":"mallory"`, 1)
+	if edited == string(buf) {
+		t.Fatalf("no login record in %s", buf)
+	}
+	if err := ioutil.WriteFile(audit.path, []byte(edited), 0600); err != nil {
+		t.Fatal(err)
+	}
+	audit.mu.Lock()
+	audit.size = int64(len(edited))
+	audit.mu.Unlock()
+	rsp := getWithToken(t, srv.URL+"/v1.0/audit", token)
+	if rsp.Code != "200" || rsp.Object["intact"] != false || rsp.Object["error"] == nil {
+		t.Fatalf("after editing: %+v", rsp)
+	}
+}
+
+func TestAuditRotation(t *testing.T) {
+	a := newTestAudit(t, 512)
+	for i := 0; i < 20; i++ {
+		a.recordSystem("", auditUserCreate, "user", outcomeSuccess)
+	}
+	files, err := a.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 3 {
+		t.Fatalf("files %v, want rotated files", files)
+	}
+	records, err := a.query(auditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 20 {
+		t.Fatalf("%d records, want 20", len(records))
+	}
+	for i := 1; i < len(records); i++ {
+		if records[i].PrevHash != records[i-1].Hash {
+			t.Fatalf("record %d does not link to the one before", i)
+		}
+	}
+
+	// Reopening continues the chain from the last file.
+	a.close()
+	reopened, err := newAuditLog(a.path, a.maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.close()
+	reopened.recordSystem("", auditUserDelete, "user", outcomeSuccess)
+	if _, err := reopened.query(auditFilter{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuditRotatedFileTampered(t *testing.T) {
+	a := newTestAudit(t, 512)
+	for i := 0; i < 20; i++ {
+		a.recordSystem("", auditUserCreate, "user", outcomeSuccess)
+	}
+	files, err := a.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(files[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.query(auditFilter{}); !errors.Is(err, errAuditChain) {
+		t.Fatalf("got %v, want %v", err, errAuditChain)
+	}
+}
+
+func TestAuditPrune(t *testing.T) {
+	newTestServer(t)
+	c := *liveConfig()
+	c.Daemon.AuditMaxBackups = 2
+	live.Store(&c)
+
+	a := newTestAudit(t, 512)
+	for i := 0; i < 20; i++ {
+		a.recordSystem("", auditUserCreate, "user", outcomeSuccess)
+	}
+	files, err := a.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("files %v, want 2 rotated and the current one", files)
+	}
+	records, err := a.query(auditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) == 0 || len(records) == 20 {
+		t.Fatalf("%d records kept", len(records))
+	}
+
+	a.close()
+	reopened, err := newAuditLog(a.path, a.maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.close()
+	reopened.recordSystem("", auditUserDelete, "user", outcomeSuccess)
+	if _, err := reopened.query(auditFilter{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuditFilter(t *testing.T) {
+	now := time.Now().UTC()
+	rec := auditRecord{Time: now, Actor: "admin", Action: auditLogin}
+	for _, test := range []struct {
+		name   string
+		filter auditFilter
+		match  bool
+	}{
+		{"none", auditFilter{}, true},
+		{"default realm", auditFilter{realm: defaultRealmName}, true},
+		{"other realm", auditFilter{realm: "acme"}, false},
+		{"actor", auditFilter{actor: "admin"}, true},
+		{"other actor", auditFilter{actor: "bob"}, false},
+		{"action", auditFilter{action: auditLogin}, true},
+		{"other action", auditFilter{action: auditLogout}, false},
+		{"from before", auditFilter{from: now.Add(-time.Minute)}, true},
+		{"from after", auditFilter{from: now.Add(time.Minute)}, false},
+		{"to after", auditFilter{to: now.Add(time.Minute)}, true},
+		{"to before", auditFilter{to: now.Add(-time.Minute)}, false},
+	} {
+		if got := test.filter.match(rec); got != test.match {
+			t.Errorf("%s: match %v, want %v", test.name, got, test.match)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golibs/uuid"
+	"github.com/kardianos/service"
+)
+
+var captchaLogger = logger.With("component", "captcha")
+
+const (
+	captchaExpiration = 5 * time.Minute
+	failureWindow     = 15 * time.Minute
+
+	// Both maps are filled by unauthenticated requests, so they are
+	// bounded. When full, the oldest entry gives way.
+	maxCaptchas = 10000
+	maxFailures = 100000
+
+	// sweepInterval is how often expired challenges and failure counts
+	// are dropped.
+	sweepInterval = time.Minute
+)
+
+var captchas = &captchaStore{
+	challenges: make(map[string]*captcha),
+	failures:   make(map[string]*failureCount),
+}
+
+type captcha struct {
+	question string
+	answer   string
+	expires  time.Time
+}
+
+type failureCount struct {
+	count int
+	last  time.Time
+}
+
+// captchaStore holds outstanding challenges and the failed login count of
+// each remote address.
+type captchaStore struct {
+	mu         sync.Mutex
+	challenges map[string]*captcha
+	failures   map[string]*failureCount
+}
+
+func randInt(max int64) int64 {
+	n, err := rand.Int(rand.Reader, big.NewInt(max))
+	if err != nil {
+		panic(err.Error())
+	}
+	return n.Int64()
+}
+
+// newChallenge creates an arithmetic challenge and returns its ID.
+func (c *captchaStore) newChallenge() (string, *captcha) {
+	a, b := randInt(50)+1, randInt(50)+1
+	ch := &captcha{expires: time.Now().Add(captchaExpiration)}
+	if randInt(2) == 0 {
+		ch.question = fmt.Sprintf("%d + %d = ?", a, b)
+		ch.answer = strconv.FormatInt(a+b, 10)
+	} else {
+		if a < b {
+			a, b = b, a
+		}
+		ch.question = fmt.Sprintf("%d - %d = ?", a, b)
+		ch.answer = strconv.FormatInt(a-b, 10)
+	}
+	id := strings.Replace(uuid.Rand().Hex(), "-", "", -1)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.challenges) >= maxCaptchas {
+		c.sweepLocked()
+	}
+	if len(c.challenges) >= maxCaptchas {
+		var oldest string
+		for k, v := range c.challenges {
+			if oldest == "" || v.expires.Before(c.challenges[oldest].expires) {
+				oldest = k
+			}
+		}
+		delete(c.challenges, oldest)
+	}
+	c.challenges[id] = ch
+	return id, ch
+}
+
+// sweep drops expired challenges and failure counts outside the window.
+func (c *captchaStore) sweep() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sweepLocked()
+}
+
+func (c *captchaStore) sweepLocked() {
+	now := time.Now()
+	for k, v := range c.challenges {
+		if now.After(v.expires) {
+			delete(c.challenges, k)
+		}
+	}
+	for ip, f := range c.failures {
+		if now.Sub(f.last) > failureWindow {
+			delete(c.failures, ip)
+		}
+	}
+}
+
+// sweepChallenges sweeps the stores of unauthenticated challenges, and
+// the sessions counted as active, until exit is closed.
+func sweepChallenges(exit chan struct{}) {
+	t := time.NewTicker(sweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-exit:
+			return
+		case <-t.C:
+			captchas.sweep()
+			activeSessions.sweep()
+			realmsMu.RLock()
+			for _, r := range realms {
+				r.keys.sweep()
+				r.webauthnChallenges.sweep()
+			}
+			realmsMu.RUnlock()
+		}
+	}
+}
+
+// solve checks answer against the challenge id. A challenge can be used
+// only once, whatever the outcome.
+func (c *captchaStore) solve(id, answer string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, ok := c.challenges[id]
+	if !ok {
+		return false
+	}
+	delete(c.challenges, id)
+	if time.Now().After(ch.expires) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(ch.answer), []byte(strings.TrimSpace(answer))) == 1
+}
+
+func (c *captchaStore) fail(ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.failures[ip]
+	if !ok && len(c.failures) >= maxFailures {
+		c.sweepLocked()
+		if len(c.failures) >= maxFailures {
+			var oldest string
+			for k, v := range c.failures {
+				if oldest == "" || v.last.Before(c.failures[oldest].last) {
+					oldest = k
+				}
+			}
+			delete(c.failures, oldest)
+		}
+	}
+	if !ok || time.Since(f.last) > failureWindow {
+		f = &failureCount{}
+		c.failures[ip] = f
+	}
+	f.count++
+	f.last = time.Now()
+}
+
+func (c *captchaStore) reset(ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.failures, ip)
+}
+
+// required reports whether logins from ip must solve a challenge.
+func (c *captchaStore) required(ip string) bool {
+	after := liveConfig().Daemon.CaptchaAfter
+	if after <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.failures[ip]
+	return ok && time.Since(f.last) <= failureWindow && f.count >= after
+}
+
+// challengeObject describes a new challenge for the client, with the
+// question only as a PNG image: as text a script would read it.
+func challengeObject() map[string]string {
+	id, ch := captchas.newChallenge()
+	obj := map[string]string{
+		"captcha_id": id,
+	}
+	if img, err := renderCaptcha(ch.question); err == nil {
+		obj["image"] = "data:image/png;base64," + img
+	} else {
+		captchaLogger.Error(err.Error())
+	}
+	return obj
+}
+
+func Captcha(s service.Service, w http.ResponseWriter, req *http.Request, session *Session) {
+	var data Rsp
+	data.Code = "200"
+	data.Object = challengeObject()
+	output(w, data)
+}
+
+// glyphs is a 3x5 bitmap font covering the characters of a question.
+var glyphs = map[rune][5]string{
+	'0': {"111", "101", "101", "101", "111"},
+	'1': {"010", "110", "010", "010", "111"},
+	'2': {"111", "001", "111", "100", "111"},
+	'3': {"111", "001", "111", "001", "111"},
+	'4': {"101", "101", "111", "001", "001"},
+	'5': {"111", "100", "111", "001", "111"},
+	'6': {"111", "100", "111", "101", "111"},
+	'7': {"111", "001", "010", "010", "010"},
+	'8': {"111", "101", "111", "101", "111"},
+	'9': {"111", "101", "111", "001", "111"},
+	'+': {"000", "010", "111", "010", "000"},
+	'-': {"000", "000", "111", "000", "000"},
+	'=': {"000", "111", "000", "111", "000"},
+	'?': {"111", "001", "011", "000", "010"},
+	' ': {"000", "000", "000", "000", "000"},
+}
+
+// renderCaptcha draws text with jittered glyphs and noise and returns the
+// base64 encoded PNG.
+func renderCaptcha(text string) (string, error) {
+	const scale, pad = 4, 6
+	width := pad*2 + len(text)*4*scale
+	height := pad*2 + 5*scale + scale*2
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	bg := color.RGBA{0xf4, 0xf4, 0xf4, 0xff}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, bg)
+		}
+	}
+	for i := 0; i < width*height/12; i++ {
+		gray := uint8(120 + randInt(100))
+		img.Set(int(randInt(int64(width))), int(randInt(int64(height))), color.RGBA{gray, gray, gray, 0xff})
+	}
+	ink := color.RGBA{0x20, 0x30, 0x60, 0xff}
+	for i, r := range text {
+		glyph, ok := glyphs[r]
+		if !ok {
+			continue
+		}
+		x0 := pad + i*4*scale
+		y0 := pad + int(randInt(scale*2))
+		for gy, row := range glyph {
+			for gx, bit := range row {
+				if bit != '1' {
+					continue
+				}
+				for dy := 0; dy < scale; dy++ {
+					for dx := 0; dx < scale; dx++ {
+						img.Set(x0+gx*scale+dx, y0+gy*scale+dy, ink)
+					}
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
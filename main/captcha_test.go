@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestChallengeImageOnly(t *testing.T) {
+	obj := challengeObject()
+	if _, ok := obj["question"]; ok {
+		t.Error("question sent as text")
+	}
+	const prefix = "data:image/png;base64,"
+	if !strings.HasPrefix(obj["image"], prefix) {
+		t.Fatalf("image %.40q", obj["image"])
+	}
+	buf, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(obj["image"], prefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := png.Decode(bytes.NewReader(buf)); err != nil {
+		t.Fatal(err)
+	}
+	if captchas.solve(obj["captcha_id"], "not a number") {
+		t.Error("wrong answer accepted")
+	}
+}
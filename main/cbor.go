@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var errCBORShort = errors.New("cbor: unexpected end of data")
+
+// cborDecode decodes the first CBOR item in buf, as used by WebAuthn
+// attestation objects and COSE keys, and returns it with the number of
+// bytes consumed. Maps decode to map[interface{}]interface{}, integers to
+// int64, byte strings to []byte and text to string.
+func cborDecode(buf []byte) (interface{}, int, error) {
+	return cborItem(buf, 0)
+}
+
+func cborItem(buf []byte, depth int) (interface{}, int, error) {
+	if depth > 16 {
+		return nil, 0, errors.New("cbor: nesting too deep")
+	}
+	if len(buf) < 1 {
+		return nil, 0, errCBORShort
+	}
+	major := buf[0] >> 5
+	info := buf[0] & 0x1f
+	n := 1
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24:
+		if len(buf) < 2 {
+			return nil, 0, errCBORShort
+		}
+		arg = uint64(buf[1])
+		n = 2
+	case info == 25:
+		if len(buf) < 3 {
+			return nil, 0, errCBORShort
+		}
+		arg = uint64(binary.BigEndian.Uint16(buf[1:]))
+		n = 3
+	case info == 26:
+		if len(buf) < 5 {
+			return nil, 0, errCBORShort
+		}
+		arg = uint64(binary.BigEndian.Uint32(buf[1:]))
+		n = 5
+	case info == 27:
+		if len(buf) < 9 {
+			return nil, 0, errCBORShort
+		}
+		arg = binary.BigEndian.Uint64(buf[1:])
+		n = 9
+	default:
+		return nil, 0, fmt.Errorf("cbor: unsupported additional info %d", info)
+	}
+
+	switch major {
+	case 0:
+		return int64(arg), n, nil
+	case 1:
+		return -1 - int64(arg), n, nil
+	case 2, 3:
+		if uint64(len(buf)-n) < arg {
+			return nil, 0, errCBORShort
+		}
+		data := buf[n : n+int(arg)]
+		if major == 3 {
+			return string(data), n + int(arg), nil
+		}
+		return append([]byte(nil), data...), n + int(arg), nil
+	case 4:
+		if arg > uint64(len(buf)) {
+			return nil, 0, errCBORShort
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			item, m, err := cborItem(buf[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			items = append(items, item)
+			n += m
+		}
+		return items, n, nil
+	case 5:
+		if arg > uint64(len(buf)) {
+			return nil, 0, errCBORShort
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			key, kn, err := cborItem(buf[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += kn
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, 0, errors.New("cbor: unsupported map key")
+			}
+			val, vn, err := cborItem(buf[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += vn
+			m[key] = val
+		}
+		return m, n, nil
+	case 7:
+		switch info {
+		case 20:
+			return false, n, nil
+		case 21:
+			return true, n, nil
+		case 22:
+			return nil, n, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("cbor: unsupported major type %d", major)
+}
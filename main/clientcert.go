@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/liuzhiyi/daemon/config"
+)
+
+// authCertificate marks sessions authenticated by a client certificate
+// rather than a login.
+const authCertificate = "certificate"
+
+// certMapping maps a client certificate subject, as in
+// "CN=build-01,O=fleet", to a user of the realm, to roles, or to both.
+// Without a username the certificate's common name is the username.
+type certMapping struct {
+	Subject  string   `json:"subject"`
+	Username string   `json:"username"`
+	Roles    []string `json:"roles"`
+}
+
+// clientAuth makes tc request client certificates as configured and
+// verify them against the client CA.
+func clientAuth(tc *tls.Config, c config.Daemon) error {
+	switch c.TLSClientAuth {
+	case "optional":
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil
+	}
+	if c.TLSClientCA == c.TLSCACert {
+		if _, err := ensureCA(c); err != nil {
+			return err
+		}
+	}
+	buf, err := ioutil.ReadFile(c.TLSClientCA)
+	if err != nil {
+		return err
+	}
+	tc.ClientCAs = x509.NewCertPool()
+	if !tc.ClientCAs.AppendCertsFromPEM(buf) {
+		return errors.New(c.TLSClientCA + ": no certificates found")
+	}
+	return nil
+}
+
+// certMappings indexes the client certificate mappings of a realm by
+// subject.
+func certMappings(list []certMapping) map[string]certMapping {
+	m := make(map[string]certMapping)
+	for _, c := range list {
+		m[c.Subject] = c
+	}
+	return m
+}
+
+// certUser returns the user the verified client certificate of req maps
+// to in the realm of req.
+func certUser(req *http.Request) (*user, *x509.Certificate, bool) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return nil, nil, false
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	r := realmOf(req)
+	realmsMu.RLock()
+	defer realmsMu.RUnlock()
+	m, ok := r.clientCerts[cert.Subject.String()]
+	if !ok {
+		return nil, nil, false
+	}
+	u := &user{username: cert.Subject.CommonName, roles: m.Roles}
+	if m.Username != "" {
+		known, ok := r.users[m.Username]
+		if !ok {
+			return nil, nil, false
+		}
+		u = &user{username: known.username, roles: known.roles}
+		if len(m.Roles) > 0 {
+			u.roles = m.Roles
+		}
+	}
+	return u, cert, u.username != ""
+}
+
+// certSession returns the session of a request authenticated by a client
+// certificate. It is granted every scope of the mapped roles and keyed
+// by the certificate, so that values set on it persist across requests.
+func certSession(req *http.Request) (*Session, bool) {
+	u, cert, ok := certUser(req)
+	if !ok {
+		return nil, false
+	}
+	sum := sha256.Sum256(cert.Raw)
+	s := &Session{
+		sid:       "cert." + hex.EncodeToString(sum[:16]),
+		realm:     realmOf(req),
+		container: make(map[string]string),
+	}
+	storeGet(s)
+	s.container["username"] = u.username
+	s.container["scope"] = strings.Join(grantScopes("", u.roles), " ")
+	s.container["auth"] = authCertificate
+	return s, true
+}
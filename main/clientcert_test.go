@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCertUser(t *testing.T) {
+	newTestServer(t)
+	defaultRealm.clientCerts = certMappings([]certMapping{
+		{Subject: "CN=build-01,O=fleet", Roles: []string{"user"}},
+		{Subject: "CN=ops,O=fleet", Username: "admin"},
+		{Subject: "CN=deploy,O=fleet", Username: "admin", Roles: []string{"user"}},
+		{Subject: "CN=ghost,O=fleet", Username: "ghost"},
+	})
+	for _, test := range []struct {
+		name, cn string
+		verified bool
+		username string
+		roles    string
+	}{
+		{"common name as username", "build-01", true, "build-01", "user"},
+		{"mapped to a user", "ops", true, "admin", "admin"},
+		{"mapped to a user with roles", "deploy", true, "admin", "user"},
+		{"mapped to an unknown user", "ghost", true, "", ""},
+		{"not mapped", "stranger", true, "", ""},
+		{"not verified", "build-01", false, "", ""},
+	} {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: test.cn, Organization: []string{"fleet"}}}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		if test.verified {
+			req.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+		}
+		u, _, ok := certUser(req)
+		if ok != (test.username != "") {
+			t.Errorf("%s: mapped %v", test.name, ok)
+			continue
+		}
+		if ok && (u.username != test.username || strings.Join(u.roles, ",") != test.roles) {
+			t.Errorf("%s: user %s with roles %v", test.name, u.username, u.roles)
+		}
+	}
+}
+
+func TestCertLogin(t *testing.T) {
+	newTestServer(t)
+	dir := t.TempDir()
+	c := *liveConfig()
+	c.Daemon.TLSCACert = filepath.Join(dir, "ca.pem")
+	c.Daemon.TLSCAKey = filepath.Join(dir, "ca-key.pem")
+	c.Daemon.TLSClientCA = c.Daemon.TLSCACert
+	c.Daemon.TLSClientAuth = "optional"
+	live.Store(&c)
+	defaultRealm.clientCerts = certMappings([]certMapping{{Subject: "CN=ops,O=fleet", Username: "admin"}})
+
+	ca, err := ensureCA(c.Daemon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "ops", Organization: []string{"fleet"}},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	if err := createCert(tmpl, ca, key, time.Hour, certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(createRouters(nil))
+	srv.TLS = &tls.Config{}
+	if err := clientAuth(srv.TLS, c.Daemon); err != nil {
+		t.Fatal(err)
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	for _, test := range []struct {
+		name  string
+		certs []tls.Certificate
+		code  string
+	}{
+		{"with certificate", []tls.Certificate{clientCert}, "200"},
+		{"without certificate", nil, errLoginRequired.Code},
+	} {
+		// A transport of its own, so that no connection is reused.
+		transport := srv.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.Certificates = test.certs
+		rsp, err := (&http.Client{Transport: transport}).Get(srv.URL + "/v1.0/audit")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out testRsp
+		json.NewDecoder(rsp.Body).Decode(&out)
+		rsp.Body.Close()
+		if out.Code != test.code {
+			t.Errorf("%s: %+v", test.name, out)
+		}
+	}
+}
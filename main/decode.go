@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// fieldError reports one invalid field of a request body.
+type fieldError struct {
+	Field string `json:"field"`
+	Rule  string `json:"rule"`
+	Msg   string `json:"msg"`
+}
+
+// validator is implemented by request structs with checks spanning
+// several fields. It runs after the field rules.
+type validator interface {
+	validate() []fieldError
+}
+
+// decodeRequest decodes a JSON or form-encoded body into v, a pointer to
+// a struct of string fields named by json tags and checked by validate
+// tags:
+//
+//	required    the field must be present and not empty
+//	max=n       at most n characters
+//	pattern=re  a non-empty value must match re; this rule comes last
+//
+// On failure it writes the error, listing every invalid field, and
+// returns false.
+func decodeRequest(w http.ResponseWriter, req *http.Request, v interface{}) bool {
+	values, apiErr := readBody(req)
+	if apiErr != nil {
+		writeError(w, req, apiErr, nil)
+		return false
+	}
+	errs := assign(values.fields, reflect.ValueOf(v).Elem())
+	errs = append(values.errs, errs...)
+	if c, ok := v.(validator); ok {
+		errs = append(errs, c.validate()...)
+	}
+	errs = firstPerField(errs)
+	if len(errs) > 0 {
+		sort.SliceStable(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+		for i := range errs {
+			errs[i].Msg = fieldMsg(req, errs[i])
+		}
+		writeError(w, req, errBadParams, map[string]interface{}{"errors": errs})
+		return false
+	}
+	return true
+}
+
+// firstPerField keeps the first error reported for each field. A value
+// of the wrong type is reported first and is then also missing to the
+// later checks, which would only repeat it.
+func firstPerField(errs []fieldError) []fieldError {
+	seen := make(map[string]bool)
+	kept := errs[:0]
+	for _, e := range errs {
+		if !seen[e.Field] {
+			seen[e.Field] = true
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+type bodyValues struct {
+	fields map[string]string
+	errs   []fieldError
+}
+
+// readBody reads at most max-body bytes of a JSON or form body into flat
+// string values.
+func readBody(req *http.Request) (bodyValues, *apiError) {
+	values := bodyValues{fields: make(map[string]string)}
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || (mediaType != "application/json" && mediaType != "application/x-www-form-urlencoded") {
+		return values, errUnsupportedType
+	}
+	maxBody := int64(liveConfig().Daemon.MaxBody)
+	if req.ContentLength > maxBody {
+		return values, errBodyTooLarge
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBody+1))
+	if err != nil {
+		requestLogger(req).Info(err.Error())
+		return values, errSystem
+	}
+	if int64(len(buf)) > maxBody {
+		return values, errBodyTooLarge
+	}
+
+	if mediaType == "application/x-www-form-urlencoded" {
+		form, err := url.ParseQuery(string(buf))
+		if err != nil {
+			requestLogger(req).Info(err.Error())
+			return values, errDecode
+		}
+		for name, v := range form {
+			if len(v) > 1 {
+				values.errs = append(values.errs, fieldError{Field: name, Rule: "single"})
+				continue
+			}
+			values.fields[name] = v[0]
+		}
+		return values, nil
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(buf, &raw); err != nil || raw == nil {
+		if err != nil {
+			requestLogger(req).Info(err.Error())
+		}
+		return values, errDecode
+	}
+	for name, v := range raw {
+		s, ok := v.(string)
+		if !ok {
+			values.errs = append(values.errs, fieldError{Field: name, Rule: "string"})
+			continue
+		}
+		values.fields[name] = s
+	}
+	return values, nil
+}
+
+// assign copies fields into the struct rv and checks the validate tags.
+func assign(fields map[string]string, rv reflect.Value) []fieldError {
+	var errs []fieldError
+	known := make(map[string]bool)
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		known[name] = true
+		value, present := fields[name]
+		rv.Field(i).SetString(value)
+		rules := strings.Split(f.Tag.Get("validate"), ",")
+		for j, rule := range rules {
+			if rule == "" {
+				continue
+			}
+			// A pattern may itself contain commas and must come last.
+			if strings.HasPrefix(rule, "pattern=") {
+				rule = strings.Join(rules[j:], ",")
+			}
+			if !checkRule(rule, value, present) {
+				errs = append(errs, fieldError{Field: name, Rule: rule})
+				break
+			}
+			if strings.HasPrefix(rule, "pattern=") {
+				break
+			}
+		}
+	}
+	for name := range fields {
+		if !known[name] {
+			errs = append(errs, fieldError{Field: name, Rule: "unknown"})
+		}
+	}
+	return errs
+}
+
+var patterns = struct {
+	sync.Mutex
+	m map[string]*regexp.Regexp
+}{m: make(map[string]*regexp.Regexp)}
+
+func checkRule(rule, value string, present bool) bool {
+	name, arg := rule, ""
+	if i := strings.Index(rule, "="); i >= 0 {
+		name, arg = rule[:i], rule[i+1:]
+	}
+	switch name {
+	case "required":
+		return present && value != ""
+	case "max":
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			panic("validate: bad rule " + rule)
+		}
+		return utf8.RuneCountInString(value) <= n
+	case "pattern":
+		if value == "" {
+			return true
+		}
+		patterns.Lock()
+		re, ok := patterns.m[arg]
+		if !ok {
+			re = regexp.MustCompile(arg)
+			patterns.m[arg] = re
+		}
+		patterns.Unlock()
+		return re.MatchString(value)
+	}
+	panic("validate: unknown rule " + rule)
+}
+
+// fieldMsg describes e in the language of req.
+func fieldMsg(req *http.Request, e fieldError) string {
+	name, arg := e.Rule, ""
+	if i := strings.Index(e.Rule, "="); i >= 0 {
+		name, arg = e.Rule[:i], e.Rule[i+1:]
+	}
+	return fmt.Sprintf(msg(req, "field_"+name), e.Field, arg)
+}
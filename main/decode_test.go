@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDecodeTypeErrorOnly(t *testing.T) {
+	srv := newTestServer(t)
+	for _, body := range []string{
+		`{"username": "admin", "password": 123456}`,
+		`{"username": "admin", "password": null}`,
+	} {
+		rsp := postRaw(t, srv.URL+"/v1.0/token", body)
+		errs, _ := rsp.Object["errors"].([]interface{})
+		if rsp.Code != errBadParams.Code || len(errs) != 1 {
+			t.Fatalf("%s: got %+v", body, rsp)
+		}
+		if e := errs[0].(map[string]interface{}); e["field"] != "password" || e["rule"] != "string" {
+			t.Errorf("%s: got %v", body, e)
+		}
+	}
+
+	rsp := postRaw(t, srv.URL+"/v1.0/token", `{"username": "admin"}`)
+	errs, _ := rsp.Object["errors"].([]interface{})
+	if len(errs) != 1 || errs[0].(map[string]interface{})["rule"] != "required" {
+		t.Errorf("missing password: got %+v", rsp)
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	srv := newTestServer(t)
+	c := *liveConfig()
+	c.Daemon.MaxBody = 256
+	live.Store(&c)
+
+	for _, test := range []struct {
+		name, contentType, body string
+		err                     *apiError
+		field, rule             string
+	}{
+		{"unknown JSON field", "application/json", `{"username":"admin","password":"x","role":"root"}`, errBadParams, "role", "unknown"},
+		{"unknown form field", "application/x-www-form-urlencoded", "username=admin&password=x&role=root", errBadParams, "role", "unknown"},
+		{"repeated form field", "application/x-www-form-urlencoded", "username=admin&username=root&password=x", errBadParams, "username", "single"},
+		{"too long", "application/json", `{"username":"` + strings.Repeat("a", 65) + `","password":"x"}`, errBadParams, "username", "max=64"},
+		{"malformed JSON", "application/json", `{"username":`, errDecode, "", ""},
+		{"JSON array", "application/json", `["admin"]`, errDecode, "", ""},
+		{"plain text", "text/plain", "admin", errUnsupportedType, "", ""},
+		{"too large", "application/json", `{"username":"` + strings.Repeat("a", 300) + `"}`, errBodyTooLarge, "", ""},
+	} {
+		rsp, err := http.Post(srv.URL+"/v1.0/token", test.contentType, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out testRsp
+		json.NewDecoder(rsp.Body).Decode(&out)
+		rsp.Body.Close()
+		if rsp.StatusCode != test.err.Status || out.Code != test.err.Code {
+			t.Errorf("%s: status %d, %+v", test.name, rsp.StatusCode, out)
+			continue
+		}
+		if test.field == "" {
+			continue
+		}
+		errs, _ := out.Object["errors"].([]interface{})
+		if len(errs) != 1 {
+			t.Errorf("%s: errors %v", test.name, errs)
+			continue
+		}
+		if e := errs[0].(map[string]interface{}); e["field"] != test.field || e["rule"] != test.rule {
+			t.Errorf("%s: got %v", test.name, e)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/liuzhiyi/daemon/config"
+)
+
+func TestStopDrains(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		drain time.Duration
+		// finish is how long the request in flight still takes.
+		finish time.Duration
+		served bool
+	}{
+		{"within the drain timeout", 2 * time.Second, 200 * time.Millisecond, true},
+		{"past the drain timeout", 200 * time.Millisecond, 2 * time.Second, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			newTestServer(t)
+			c := *liveConfig()
+			c.Daemon.DrainTimeout = config.Duration(test.drain)
+			live.Store(&c)
+
+			started := make(chan struct{})
+			p := &program{
+				exit: make(chan struct{}),
+				done: make(chan struct{}),
+				srv: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+					close(started)
+					time.Sleep(test.finish)
+					io.WriteString(w, "done")
+				})},
+			}
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go func() {
+				p.srv.Serve(ln)
+				close(p.done)
+			}()
+
+			type result struct {
+				body string
+				err  error
+			}
+			results := make(chan result, 1)
+			go func() {
+				rsp, err := http.Get("http://" + ln.Addr().String() + "/")
+				if err != nil {
+					results <- result{err: err}
+					return
+				}
+				defer rsp.Body.Close()
+				body, err := io.ReadAll(rsp.Body)
+				results <- result{string(body), err}
+			}()
+			<-started
+
+			restarted := false
+			begin := time.Now()
+			if !p.stop(func() { restarted = true }) {
+				t.Fatal("stop did not stop")
+			}
+			took := time.Since(begin)
+			if !restarted {
+				t.Error("restarted not called")
+			}
+			if _, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+				t.Error("still accepting connections")
+			}
+			res := <-results
+			if test.served {
+				if res.err != nil || res.body != "done" {
+					t.Fatalf("request in flight: %q, %v", res.body, res.err)
+				}
+				if took < test.finish/2 {
+					t.Errorf("stop returned after %s, before the request finished", took)
+				}
+			} else {
+				if res.err == nil {
+					t.Fatalf("request in flight served past the drain timeout: %q", res.body)
+				}
+				if took > test.finish {
+					t.Errorf("stop took %s, past the drain timeout of %s", took, test.drain)
+				}
+			}
+			if p.stop(nil) {
+				t.Error("second stop stopped again")
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+)
+
+// apiError is an entry of the error catalog. Code is the stable code
+// clients branch on, Status the HTTP status it is sent with and Key the
+// key of its message in the messages catalog.
+type apiError struct {
+	Code   string
+	Status int
+	Key    string
+}
+
+func (e *apiError) Error() string {
+	return e.Code + " " + e.Key
+}
+
+var (
+	errSystem          = &apiError{"100", http.StatusInternalServerError, "system_error"}
+	errDecode          = &apiError{"201", http.StatusBadRequest, "decode_error"}
+	errCredentials     = &apiError{"202", http.StatusUnauthorized, "bad_credentials"}
+	errForbidden       = &apiError{"203", http.StatusForbidden, "insufficient_scope"}
+	errOTPRequired     = &apiError{"204", http.StatusUnauthorized, "otp_required"}
+	errCaptchaRequired = &apiError{"205", http.StatusUnauthorized, "captcha_required"}
+	errWebauthn        = &apiError{"206", http.StatusBadRequest, "webauthn_failed"}
+	errLoginRequired   = &apiError{"207", http.StatusUnauthorized, "login_required"}
+	errWrongPassword   = &apiError{"208", http.StatusUnauthorized, "wrong_password"}
+	errRestartFailed   = &apiError{"209", http.StatusInternalServerError, "restart_failed"}
+	errBadParams       = &apiError{"301", http.StatusBadRequest, "bad_params"}
+	errUnsupportedType = &apiError{"302", http.StatusUnsupportedMediaType, "unsupported_media_type"}
+	errBodyTooLarge    = &apiError{"303", http.StatusRequestEntityTooLarge, "body_too_large"}
+)
+
+// writeError sends e with its HTTP status and a message in the language of
+// req. object carries extra details, such as a new captcha challenge, and
+// may be nil.
+func writeError(w http.ResponseWriter, req *http.Request, e *apiError, object interface{}) {
+	respond(w, e.Status, Rsp{Code: e.Code, Key: e.Key, Msg: msg(req, e.Key), Object: object})
+}
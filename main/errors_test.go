@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/liuzhiyi/daemon/common"
+)
+
+var catalog = []*apiError{
+	errSystem, errDecode, errCredentials, errForbidden, errOTPRequired,
+	errCaptchaRequired, errWebauthn, errLoginRequired, errWrongPassword,
+	errRestartFailed, errBadParams, errUnsupportedType, errBodyTooLarge,
+}
+
+func TestErrorCatalog(t *testing.T) {
+	codes := make(map[string]bool)
+	keys := make(map[string]bool)
+	for _, e := range catalog {
+		if codes[e.Code] || keys[e.Key] {
+			t.Errorf("%v: code or key used twice", e)
+		}
+		codes[e.Code], keys[e.Key] = true, true
+		if e.Status < 400 {
+			t.Errorf("%v: status %d", e, e.Status)
+		}
+		for _, lang := range []string{common.LangZH, common.LangEN} {
+			if messages[lang][e.Key] == "" {
+				t.Errorf("%v: no %s message", e, lang)
+			}
+		}
+	}
+	// Every language has the same messages.
+	for key := range messages[common.LangZH] {
+		if messages[common.LangEN][key] == "" {
+			t.Errorf("%s: no %s message", key, common.LangEN)
+		}
+	}
+	for key := range messages[common.LangEN] {
+		if messages[common.LangZH][key] == "" {
+			t.Errorf("%s: no %s message", key, common.LangZH)
+		}
+	}
+}
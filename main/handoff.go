@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/kardianos/service"
+)
+
+var handoffLogger = logger.With("component", "handoff")
+
+const (
+	// listenFDEnv names the descriptor of the listening socket handed
+	// down to the program handoff replaces the daemon with.
+	listenFDEnv = "SIMPLEAUTH_LISTEN_FD"
+
+	handoffTimeout = 30 * time.Second
+)
+
+// underService reports whether the daemon runs under the service manager.
+// Handoff replaces the daemon in place, so the answer does not change.
+func underService() bool {
+	return !service.Interactive()
+}
+
+var errHandoffUnsupported = errors.New("listener handoff is not supported on this platform")
+
+var errNotUnderService = errors.New("not running under the service manager")
+
+// prepareRestart checks that the daemon can restart the configured way
+// and returns the function restarting it: through the service manager,
+// which closes the listening socket, or by handing the socket to a new
+// process. Restarting drains requests in flight, so a request asking for
+// it gets the error, if any, and its answer before the restart. done is
+// called with the outcome; on success while the program stops, before
+// the audit log closes.
+func prepareRestart(s service.Service) (func(done func(error)), error) {
+	if liveConfig().Daemon.RestartMode == "handoff" {
+		return running.handoff()
+	}
+	status, err := s.Status()
+	if err != nil {
+		return nil, err
+	}
+	if status != service.StatusRunning {
+		return nil, errNotUnderService
+	}
+	return func(done func(error)) {
+		running.restarting(func() { done(nil) })
+		if err := s.Restart(); err != nil {
+			running.restarting(nil)
+			done(err)
+		}
+	}, nil
+}
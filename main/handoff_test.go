@@ -0,0 +1,64 @@
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestInheritedListener(t *testing.T) {
+	if os.Getenv(listenFDEnv) != "" {
+		// Run as the process below: answer one connection on the
+		// listener it was handed.
+		ln, err := inheritedListener()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("inherited"))
+		conn.Close()
+		return
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	cmd := exec.Command(os.Args[0], "-test.run=^TestInheritedListener$")
+	cmd.Env = append(os.Environ(), listenFDEnv+"=3")
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// Only the process started holds the socket now.
+	f.Close()
+	addr := ln.Addr().String()
+	ln.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(conn)
+	conn.Close()
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("%v: %s", err, out.String())
+	}
+	if string(got) != "inherited" {
+		t.Fatalf("got %q", got)
+	}
+}
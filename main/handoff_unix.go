@@ -0,0 +1,158 @@
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// handoff replaces the daemon with the current executable in place,
+// keeping the process ID so that the service manager goes on supervising
+// it, and hands the new program the listening socket. It first runs the
+// executable's "config check" so that a binary or configuration that
+// cannot start is reported while this one keeps serving. It returns the
+// function completing the handoff.
+//
+// Completing the handoff stops this program accepting connections,
+// drains its requests and closes its stores, which the new program
+// opens; done then records the restart before the audit log closes, and
+// the log file is closed before the executable replaces this one.
+// Connections arriving meanwhile wait in the listen queue of the socket,
+// which stays open throughout.
+func (p *program) handoff() (func(done func(error)), error) {
+	tcp, ok := p.ln.(*net.TCPListener)
+	if !ok {
+		return nil, errHandoffUnsupported
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkExecutable(exe); err != nil {
+		return nil, fmt.Errorf("handoff: %s cannot start: %v", exe, err)
+	}
+	lnFile, err := tcp.File()
+	if err != nil {
+		return nil, err
+	}
+	// The copy of the socket File returns is closed on exec; the new
+	// program must inherit it.
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, lnFile.Fd(), syscall.F_SETFD, 0); errno != 0 {
+		lnFile.Close()
+		return nil, errno
+	}
+	env := append(os.Environ(), listenFDEnv+"="+strconv.Itoa(int(lnFile.Fd())))
+	return func(done func(error)) {
+		if !p.stop(func() { done(nil) }) {
+			// Stopped by the service manager meanwhile.
+			lnFile.Close()
+			handoffLogger.Warning("stopped during handoff, not replaced")
+			return
+		}
+		handoffLogger.Infof("replacing pid %d with %s", os.Getpid(), exe)
+		if logFile != nil {
+			logFile.Close()
+			logger.SetOutput(os.Stderr)
+		}
+		err := syscall.Exec(exe, os.Args, env)
+		handoffLogger.Errorf("handoff:%s", err.Error())
+		os.Exit(1)
+	}, nil
+}
+
+// checkExecutable runs "config check" with the daemon's flags on exe,
+// which fails when the executable or the configuration cannot start.
+func checkExecutable(exe string) error {
+	cmd := exec.Command(exe, append(os.Args[1:], "config", "check")...)
+	out := make(chan error, 1)
+	var buf bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &buf, &buf
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() { out <- cmd.Wait() }()
+	select {
+	case err := <-out:
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(buf.String()))
+		}
+		return nil
+	case <-time.After(handoffTimeout):
+		cmd.Process.Kill()
+		<-out
+		return errors.New("config check timed out")
+	}
+}
+
+// inheritedListener returns the listener handed down by handoff, or nil
+// when the daemon was started normally.
+func inheritedListener() (net.Listener, error) {
+	v := os.Getenv(listenFDEnv)
+	if v == "" {
+		return nil, nil
+	}
+	os.Unsetenv(listenFDEnv)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", listenFDEnv, err)
+	}
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// notifyReady tells systemd, when it supervises the daemon with
+// Type=notify, that the daemon now serves.
+func notifyReady() {
+	if addr := os.Getenv("NOTIFY_SOCKET"); addr != "" {
+		conn, err := net.Dial("unixgram", addr)
+		if err != nil {
+			handoffLogger.Warningf("sd_notify:%s", err.Error())
+			return
+		}
+		io.WriteString(conn, "READY=1")
+		conn.Close()
+	}
+}
+
+// watchUpgrade restarts by handoff on SIGUSR2, typically after the
+// executable has been replaced by a new version.
+func watchUpgrade(exit chan struct{}) {
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	defer signal.Stop(usr2)
+	for {
+		select {
+		case <-exit:
+			return
+		case <-usr2:
+			handoffLogger.Info("SIGUSR2 received, handing over to a new process")
+			handoff, err := running.handoff()
+			if err != nil {
+				handoffLogger.Errorf("handoff:%s", err.Error())
+				restarts.inc(restartUpgrade, outcomeFailure)
+				continue
+			}
+			go handoff(func(err error) {
+				if err != nil {
+					handoffLogger.Errorf("handoff:%s", err.Error())
+					restarts.inc(restartUpgrade, outcomeFailure)
+					return
+				}
+				audit.recordSystem(defaultRealmName, auditRestart, "", outcomeSuccess)
+				restarts.inc(restartUpgrade, outcomeSuccess)
+			})
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"net"
+)
+
+func (p *program) handoff() (func(done func(error)), error) {
+	return nil, errHandoffUnsupported
+}
+
+func inheritedListener() (net.Listener, error) {
+	return nil, nil
+}
+
+func notifyReady() {}
+
+func watchUpgrade(exit chan struct{}) {}
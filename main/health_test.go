@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestSessionStoreProbe(t *testing.T) {
+	srv := newTestServer(t)
+	if err := checkSessionStore(); err != nil {
+		t.Fatal(err)
+	}
+	if isSessionID(probeKey) {
+		t.Fatalf("%q could be a session ID", probeKey)
+	}
+	activeSessions.mu.Lock()
+	n := len(activeSessions.seen)
+	activeSessions.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("%d sessions tracked after the probe", n)
+	}
+	// Even signed, the probe entry is not a session.
+	if rsp := getWithToken(t, srv.URL+"/v1.0/audit", defaultRealm.sign(probeKey)); rsp.Code != errLoginRequired.Code {
+		t.Fatalf("got %+v", rsp)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/liuzhiyi/daemon/config"
+)
+
+// newTestServer serves the daemon's routes from a fresh working
+// directory, with a new default realm, session store, session tracker and
+// audit log and without the captcha.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	logger.SetOutput(ioutil.Discard)
+
+	cfg = config.Default()
+	cfg.Daemon.CachePath = filepath.Join(dir, "cache")
+	cfg.Daemon.CaptchaAfter = 0
+	live.Store(cfg)
+	defaultRealm = newRealm(defaultRealmName, sessionName, users)
+	realms = map[string]*realm{defaultRealmName: defaultRealm}
+	activeSessions = &sessionTracker{seen: make(map[string]trackedSession)}
+	openSessions()
+	openRealms()
+	openAudit()
+
+	srv := httptest.NewServer(createRouters(nil))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newClient returns a client with its own cookie jar.
+func newClient(t *testing.T) *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Jar: jar}
+}
+
+type testRsp struct {
+	Code   string
+	Msg    string
+	Object map[string]interface{}
+}
+
+// postJSON posts body as JSON and decodes the response.
+func postJSON(t *testing.T, c *http.Client, url string, body map[string]string) testRsp {
+	t.Helper()
+	buf, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return post(t, c, url, string(buf))
+}
+
+// postRaw posts body, a JSON document, without cookies and decodes the
+// response.
+func postRaw(t *testing.T, url string, body string) testRsp {
+	t.Helper()
+	return post(t, http.DefaultClient, url, body)
+}
+
+func post(t *testing.T, c *http.Client, url string, body string) testRsp {
+	t.Helper()
+	rsp, err := c.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	var out testRsp
+	if err := json.NewDecoder(rsp.Body).Decode(&out); err != nil {
+		t.Fatalf("POST %s: %v", url, err)
+	}
+	return out
+}
+
+// login logs c in as the built-in admin.
+func login(t *testing.T, c *http.Client, base string) testRsp {
+	t.Helper()
+	rsp := postJSON(t, c, base+"/v1.0/token", map[string]string{"username": "admin", "password": "123456"})
+	if rsp.Code != "200" {
+		t.Fatalf("login: %+v", rsp)
+	}
+	return rsp
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kardianos/service"
+)
+
+var historyLogger = logger.With("component", "history")
+
+const (
+	historyPath = "/history.json"
+	historySize = 20
+
+	auditNewDevice = "login.new_device"
+)
+
+type loginEntry struct {
+	Time      time.Time `json:"time"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Success   bool      `json:"success"`
+	NewDevice bool      `json:"new_device"`
+}
+
+type userHistory struct {
+	Logins  []loginEntry         `json:"logins"`
+	Devices map[string]time.Time `json:"devices"`
+}
+
+// loginHistory keeps the last historySize logins of every user together
+// with the fingerprints of the clients each user has logged in from.
+type loginHistory struct {
+	mu    sync.Mutex
+	path  string
+	users map[string]*userHistory
+}
+
+func newLoginHistory() *loginHistory {
+	return &loginHistory{users: make(map[string]*userHistory)}
+}
+
+// load reads the history kept in dir and saves there from now on.
+func (h *loginHistory) load(dir string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.path = filepath.Join(dir, historyPath)
+	buf, err := ioutil.ReadFile(h.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			historyLogger.Errorf("login history:%s", err.Error())
+		}
+		return
+	}
+	if err := json.Unmarshal(buf, &h.users); err != nil {
+		historyLogger.Errorf("login history:%s", err.Error())
+	}
+}
+
+// fingerprint identifies the client that sent req.
+func fingerprint(req *http.Request) string {
+	sum := sha256.Sum256([]byte(req.UserAgent() + "|" + remoteIP(req)))
+	return hex.EncodeToString(sum[:])
+}
+
+func (h *loginHistory) get(username string) *userHistory {
+	uh, ok := h.users[username]
+	if !ok {
+		uh = &userHistory{Devices: make(map[string]time.Time)}
+		h.users[username] = uh
+	}
+	if uh.Devices == nil {
+		uh.Devices = make(map[string]time.Time)
+	}
+	return uh
+}
+
+// isNewDevice reports whether username has never logged in successfully
+// from the client that sent req.
+func (h *loginHistory) isNewDevice(username string, req *http.Request) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	uh, ok := h.users[username]
+	if !ok {
+		return true
+	}
+	_, known := uh.Devices[fingerprint(req)]
+	return !known
+}
+
+// add records a login attempt and, when it succeeded, remembers the device.
+func (h *loginHistory) add(username string, req *http.Request, success, newDevice bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	uh := h.get(username)
+	now := time.Now().UTC()
+	uh.Logins = append(uh.Logins, loginEntry{
+		Time:      now,
+		IP:        remoteIP(req),
+		UserAgent: req.UserAgent(),
+		Success:   success,
+		NewDevice: newDevice,
+	})
+	if len(uh.Logins) > historySize {
+		uh.Logins = uh.Logins[len(uh.Logins)-historySize:]
+	}
+	if success {
+		uh.Devices[fingerprint(req)] = now
+	}
+	h.save()
+}
+
+// last returns up to n logins of username, most recent first.
+func (h *loginHistory) last(username string, n int) []loginEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	uh, ok := h.users[username]
+	if !ok {
+		return []loginEntry{}
+	}
+	if n <= 0 || n > len(uh.Logins) {
+		n = len(uh.Logins)
+	}
+	entries := make([]loginEntry, 0, n)
+	for i := len(uh.Logins) - 1; i >= len(uh.Logins)-n; i-- {
+		entries = append(entries, uh.Logins[i])
+	}
+	return entries
+}
+
+// close stops saving the history.
+func (h *loginHistory) close() {
+	h.mu.Lock()
+	h.path = ""
+	h.mu.Unlock()
+}
+
+func (h *loginHistory) save() {
+	if h.path == "" {
+		return
+	}
+	buf, err := json.Marshal(h.users)
+	if err != nil {
+		historyLogger.Error(err.Error())
+		return
+	}
+	tmp := h.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		historyLogger.Errorf("login history:%s", err.Error())
+		return
+	}
+	if err := os.Rename(tmp, h.path); err != nil {
+		historyLogger.Errorf("login history:%s", err.Error())
+	}
+}
+
+// Logins lists the recent logins of the current user, or of any user for
+// sessions holding the users:read scope.
+func Logins(s service.Service, w http.ResponseWriter, req *http.Request, session *Session) {
+	current, logined := session.container["username"]
+	if !logined {
+		writeError(w, req, errLoginRequired, nil)
+		return
+	}
+	username := pathParam(req, "username")
+	if username == "" {
+		username = req.URL.Query().Get("username")
+	}
+	if username == "" {
+		username = current
+	}
+	if username != current && !session.hasScopes([]string{scopeUsersRead}) {
+		writeError(w, req, errForbidden, nil)
+		return
+	}
+	n, _ := strconv.Atoi(req.URL.Query().Get("n"))
+	var data Rsp
+	data.Code = "200"
+	data.Object = realmOf(req).history.last(username, n)
+	output(w, data)
+}
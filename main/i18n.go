@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/liuzhiyi/daemon/common"
+)
+
+// messages is the catalog of response messages, keyed by message key.
+var messages = common.Messages{
+	common.LangZH: {
+		"system_error":           "系统错误",
+		"decode_error":           "数据解析错误",
+		"bad_credentials":        "用户名或密码错误",
+		"insufficient_scope":     "权限不足",
+		"otp_required":           "新设备登录需要动态口令",
+		"captcha_required":       "请输入验证码",
+		"webauthn_failed":        "安全密钥验证失败",
+		"login_required":         "请登录",
+		"wrong_password":         "密码不正确",
+		"restart_failed":         "服务器重启失败",
+		"bad_params":             "参数不正确",
+		"unsupported_media_type": "不支持的请求类型，请使用 JSON 或表单",
+		"body_too_large":         "请求数据过大",
+
+		"field_required": "%[1]s 不能为空",
+		"field_max":      "%[1]s 不能超过 %[2]s 个字符",
+		"field_pattern":  "%[1]s 格式不正确",
+		"field_unknown":  "不支持的参数 %[1]s",
+		"field_string":   "%[1]s 必须是字符串",
+		"field_single":   "%[1]s 只能出现一次",
+
+		"login_success":       "登录成功",
+		"logged_out":          "已退出登录",
+		"restarting":          "服务器正在重启",
+		"key_registered":      "公钥注册成功",
+		"webauthn_registered": "安全密钥注册成功",
+	},
+	common.LangEN: {
+		"system_error":           "Internal error",
+		"decode_error":           "Malformed request body",
+		"bad_credentials":        "Wrong username or password",
+		"insufficient_scope":     "Insufficient scope",
+		"otp_required":           "A one-time password is required to log in from a new device",
+		"captcha_required":       "Please solve the captcha",
+		"webauthn_failed":        "Security key verification failed",
+		"login_required":         "Please log in",
+		"wrong_password":         "Wrong password",
+		"restart_failed":         "Failed to restart the server",
+		"bad_params":             "Invalid parameters",
+		"unsupported_media_type": "Unsupported content type, send JSON or a form",
+		"body_too_large":         "Request body too large",
+
+		"field_required": "%[1]s is required",
+		"field_max":      "%[1]s must be at most %[2]s characters",
+		"field_pattern":  "%[1]s is malformed",
+		"field_unknown":  "unknown parameter %[1]s",
+		"field_string":   "%[1]s must be a string",
+		"field_single":   "%[1]s must be given once",
+
+		"login_success":       "Logged in",
+		"logged_out":          "Logged out",
+		"restarting":          "Server restarting",
+		"key_registered":      "Public key registered",
+		"webauthn_registered": "Security key registered",
+	},
+}
+
+// language returns the response language requested by req, zh-CN unless
+// Accept-Language prefers English.
+func language(req *http.Request) string {
+	if lang := common.MatchLanguage(req.Header.Get("Accept-Language")); lang != "" {
+		return lang
+	}
+	return common.LangZH
+}
+
+// msg returns the message for key in the language of req.
+func msg(req *http.Request, key string) string {
+	return messages.Get(language(req), key)
+}
+
+// localize marks responses as depending on Accept-Language.
+func localize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Vary", "Accept-Language")
+		w.Header().Set("Content-Language", language(req))
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/liuzhiyi/daemon/common"
+)
+
+func TestLocalizedErrors(t *testing.T) {
+	srv := newTestServer(t)
+	for _, test := range []struct {
+		acceptLanguage, lang, msg string
+	}{
+		{"", common.LangZH, "用户名或密码错误"},
+		{"en-US,en;q=0.9", common.LangEN, "Wrong username or password"},
+		{"fr, en;q=0.5", common.LangEN, "Wrong username or password"},
+		{"zh-CN, en;q=0.5", common.LangZH, "用户名或密码错误"},
+	} {
+		req, _ := http.NewRequest("POST", srv.URL+"/v1.0/token", strings.NewReader(`{"username":"admin","password":"wrong"}`))
+		req.Header.Set("Content-Type", "application/json")
+		if test.acceptLanguage != "" {
+			req.Header.Set("Accept-Language", test.acceptLanguage)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out struct{ Code, Key, Msg string }
+		json.NewDecoder(rsp.Body).Decode(&out)
+		rsp.Body.Close()
+		if rsp.StatusCode != errCredentials.Status || out.Code != errCredentials.Code || out.Key != errCredentials.Key {
+			t.Errorf("%q: status %d, %+v", test.acceptLanguage, rsp.StatusCode, out)
+		}
+		if out.Msg != test.msg || rsp.Header.Get("Content-Language") != test.lang {
+			t.Errorf("%q: %s message %q", test.acceptLanguage, rsp.Header.Get("Content-Language"), out.Msg)
+		}
+		if !strings.Contains(rsp.Header.Get("Vary"), "Accept-Language") {
+			t.Errorf("%q: Vary %q", test.acceptLanguage, rsp.Header.Get("Vary"))
+		}
+	}
+}
@@ -1,93 +1,220 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
+	"os"
 	"path"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kardianos/service"
-	"github.com/liuzhiyi/daemon/common"
-	"github.com/natefinch/npipe"
+	"github.com/liuzhiyi/daemon/config"
+	"github.com/liuzhiyi/daemon/logging"
 )
 
 const (
-	addr                            = ":3000"
-	vesion                          = "1.0"
-	defaultExpiration time.Duration = 60 * 60 * time.Second
-	cachePath         string        = "/cache"
-	sessionName                     = "SESSIONID"
+	vesion      = "1.0"
+	sessionName = "SESSIONID"
 )
 
-var logger service.Logger
-var flTls *bool = flag.Bool("-tls", false, "enable tls mode")
+// logger writes to stderr until main knows whether the daemon runs under
+// the service manager.
+var logger = logging.New(os.Stderr)
+
+// logFile is where logger writes under the service manager, closed on
+// exit.
+var logFile io.Closer
+var configLoader = config.NewLoader(flag.CommandLine, "daemon")
+var cfg = config.Default()
 
 // Program structures.
 //  Define Start and Stop methods.
 type program struct {
 	exit chan struct{}
+	srv  *http.Server
+	// ln is the plain TCP listener, passed on by handoff.
+	ln net.Listener
+	// done is closed once the server has stopped serving.
+	done chan struct{}
+
+	stopOnce sync.Once
+	mu       sync.Mutex
+	// restarted records the restart the program stops for, if any.
+	restarted func()
 }
 
+// running is the started program, used to restart it by handoff.
+var running *program
+
 func (p *program) Start(s service.Service) error {
-	if service.Interactive() {
-		logger.Info("Running in terminal.")
-	} else {
+	if underService() {
 		logger.Info("Running under service manager.")
+	} else {
+		logger.Info("Running in terminal.")
 	}
 	p.exit = make(chan struct{})
+	p.done = make(chan struct{})
+
+	// Listen here so that a busy port or a bad certificate is reported
+	// to the service manager.
+	p.srv = &http.Server{Addr: cfg.Daemon.Listen}
+	ln, err := p.listen()
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+	running = p
 
 	// Start should not block. Do the actual work async.
-	go p.run(s)
+	go p.run(s, ln)
 	return nil
 }
 
-func (p *program) run(s service.Service) error {
+func (p *program) run(s service.Service, ln net.Listener) error {
+	defer close(p.done)
 	logger.Infof("I'm running %v.", service.Platform())
 	// createPipeServer()
-	httpServer(s)
+	openSessions()
+	openAudit()
+	openRealms()
+	go watchReload(p.exit)
+	go sweepChallenges(p.exit)
+	go watchUpgrade(p.exit)
+	if p.srv.TLSConfig != nil {
+		go certs.watchRenewal(p.exit)
+	}
+	go serveMetrics(p.exit)
+	p.srv.Handler = createRouters(s)
+	notifyReady()
+	atomic.StoreInt32(&serving, 1)
+	if err := p.srv.Serve(ln); err != http.ErrServerClosed {
+		logger.Error(err.Error())
+		return err
+	}
 	return nil
 }
 
+// Stop stops the program, see stop, recording the restart the service
+// manager stops it for, if any.
 func (p *program) Stop(s service.Service) error {
-	// Any work in Stop should be quick, usually a few seconds at most.
-	logger.Info("I'm Stopping!")
-	close(p.exit)
+	p.mu.Lock()
+	restarted := p.restarted
+	p.mu.Unlock()
+	p.stop(restarted)
 	return nil
 }
 
-func httpServer(s service.Service) {
-	r := createRouters(s)
-	var err error
-	if *flTls {
-		err = http.ListenAndServeTLS(addr, "cert.pem", "key.pem", r)
-	} else {
-		err = http.ListenAndServe(addr, r)
+// stop stops accepting connections and waits up to drain-timeout for
+// requests in flight before closing the rest, then closes the stores.
+// The audit log closes last, after restarted, when set, has recorded the
+// restart. Only the first call stops the program and reports true: the
+// service manager may stop it while a handoff does, and then waits for
+// the handoff's stop.
+func (p *program) stop(restarted func()) bool {
+	stopped := false
+	p.stopOnce.Do(func() {
+		stopped = true
+		logger.Info("I'm Stopping!")
+		atomic.StoreInt32(&serving, 0)
+		close(p.exit)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(liveConfig().Daemon.DrainTimeout))
+		defer cancel()
+		if err := p.srv.Shutdown(ctx); err != nil {
+			logger.Warningf("drain deadline passed, closing remaining connections:%s", err.Error())
+			p.srv.Close()
+		}
+		<-p.done
+		closeSessions()
+		closeRealms()
+		if restarted != nil {
+			restarted()
+		}
+		if err := audit.close(); err != nil {
+			auditLogger.Errorf("audit log:%s", err.Error())
+		}
+	})
+	return stopped
+}
+
+// restarting sets record to be called when the service manager stops the
+// program for the restart under way, or clears it when the restart
+// failed.
+func (p *program) restarting(record func()) {
+	p.mu.Lock()
+	p.restarted = record
+	p.mu.Unlock()
+}
+
+// listen opens the daemon's listener, or takes over the one handed down
+// by the process being replaced, with TLS when enabled.
+func (p *program) listen() (net.Listener, error) {
+	if cfg.Daemon.TLS {
+		if err := certs.load(cfg.Daemon); err != nil {
+			return nil, err
+		}
+		p.srv.TLSConfig = &tls.Config{GetCertificate: certs.getCertificate}
+		if err := clientAuth(p.srv.TLSConfig, cfg.Daemon); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := inheritedListener()
+	if err == nil && ln == nil {
+		ln, err = net.Listen("tcp", p.srv.Addr)
 	}
 	if err != nil {
-		logger.Error(err.Error())
-		panic(err.Error())
+		return nil, err
+	}
+	p.ln = ln
+	if p.srv.TLSConfig != nil {
+		ln = tls.NewListener(ln, p.srv.TLSConfig)
 	}
+	return ln, nil
 }
 
 type httpHandler func(service.Service, http.ResponseWriter, *http.Request, *Session)
 
 type route struct {
-	method string
-	path   string
-	fn     http.Handler
+	method   string
+	path     string
+	version  *apiVersion
+	segments []string
+	scopes   []string
+	roles    []string
+	fn       http.Handler
 }
 
-func (r *route) match(path string) bool {
-	fmt.Println(path, r.path)
-	return r.path == path
+// match reports whether path matches the route's pattern, returning the
+// values of its {name} segments.
+func (r *route) match(path string) (map[string]string, bool) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) != len(r.segments) {
+		return nil, false
+	}
+	var params map[string]string
+	for i, pattern := range r.segments {
+		if len(pattern) > 2 && pattern[0] == '{' && pattern[len(pattern)-1] == '}' {
+			if segments[i] == "" {
+				return nil, false
+			}
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[pattern[1:len(pattern)-1]] = segments[i]
+		} else if pattern != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
 }
 
 func (r *route) staticMatch(path string) bool {
@@ -95,7 +222,8 @@ func (r *route) staticMatch(path string) bool {
 }
 
 type Router struct {
-	routes []*route
+	routes      []*route
+	middlewares []middleware
 }
 
 func newRouter() *Router {
@@ -108,20 +236,149 @@ func (r *Router) newRoute() *route {
 	return route
 }
 
-func (r *Router) HandleFunc(s service.Service, method string, path string, handler httpHandler) {
+// Handle registers h for method and path outside the versioned API and
+// without a session, for endpoints such as /metrics that are polled by
+// machines.
+func (r *Router) Handle(method string, path string, h http.Handler) {
 	route := r.newRoute()
 	route.method = method
-	route.path = fmt.Sprintf("/v%s%s", vesion, path)
-	route.fn = r.makeHttpFnc(s, handler)
+	route.path = path
+	route.segments = strings.Split(strings.Trim(path, "/"), "/")
+	route.fn = h
+}
+
+// HandleFunc registers handler for method and path under every API
+// version. Path segments written as {name} match any value, available
+// through pathParam. When scopes are given, the session must be logged in
+// and hold every one of them.
+func (r *Router) HandleFunc(s service.Service, method string, path string, handler httpHandler, scopes ...string) {
+	r.HandleFuncVersions(apiVersions, s, method, path, handler, scopes...)
+}
+
+// HandleFuncVersions registers handler for method and path under the
+// given API versions only.
+func (r *Router) HandleFuncVersions(versions []*apiVersion, s service.Service, method string, path string, handler httpHandler, scopes ...string) {
+	r.handleVersions(versions, method, path, r.makeHttpFnc(s, handler), scopes)
+}
+
+// HandleFuncReadOnly registers handler for method and path under every
+// API version, passing it the session found by peekSession. Neither a
+// session nor a cookie is ever created, for endpoints such as /verify
+// that proxies call on every request.
+func (r *Router) HandleFuncReadOnly(s service.Service, method string, path string, handler httpHandler) {
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		handler(s, w, req, peekSession(req))
+	}
+	r.handleVersions(apiVersions, method, path, fn, nil)
+}
+
+func (r *Router) handleVersions(versions []*apiVersion, method string, path string, fn http.HandlerFunc, scopes []string) {
+	for _, v := range versions {
+		route := r.newRoute()
+		route.method = method
+		route.version = v
+		route.path = fmt.Sprintf("/v%s%s", v.name, path)
+		route.segments = strings.Split(strings.Trim(route.path, "/"), "/")
+		route.scopes = scopes
+		route.fn = fn
+	}
+}
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	realmKey
+	routeKey
+	paramsKey
+	allowedKey
+	versionKey
+	sessionKey
+)
+
+// requestID returns the ID assigned to req by the router.
+func requestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// pathParam returns the value of the {name} segment of the matched route.
+func pathParam(req *http.Request, name string) string {
+	params, _ := req.Context().Value(paramsKey).(map[string]string)
+	return params[name]
+}
+
+func routeOf(req *http.Request) *route {
+	r, _ := req.Context().Value(routeKey).(*route)
+	return r
 }
 
 func (r *Router) makeHttpFnc(s service.Service, handler httpHandler) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		session := sessionStart(w, req)
+		session, ok := req.Context().Value(sessionKey).(*Session)
+		if !ok {
+			session = sessionStart(w, req)
+		}
 		handler(s, w, req, session)
 	}
 }
 
+// lookup finds the route for method and path, preferring the match with
+// the fewest path parameters. It also returns the methods the path
+// accepts. HEAD falls back to the GET route.
+func (r *Router) lookup(method, path string) (*route, map[string]string, []string) {
+	var (
+		found    *route
+		params   map[string]string
+		fallback *route
+		fbParams map[string]string
+		allowed  []string
+		seen     = make(map[string]bool)
+	)
+	allow := func(m string) {
+		if !seen[m] {
+			seen[m] = true
+			allowed = append(allowed, m)
+		}
+	}
+	for _, route := range r.routes {
+		switch route.method {
+		case "static":
+			if route.staticMatch(path) {
+				return route, nil, nil
+			}
+			continue
+		case "proxy":
+			if route.proxyMatch(path) {
+				return route, nil, nil
+			}
+			continue
+		}
+		p, ok := route.match(path)
+		if !ok {
+			continue
+		}
+		allow(route.method)
+		if route.method == "GET" {
+			allow("HEAD")
+		}
+		if route.method == method && (found == nil || len(p) < len(params)) {
+			found, params = route, p
+		}
+		if method == "HEAD" && route.method == "GET" && (fallback == nil || len(p) < len(fbParams)) {
+			fallback, fbParams = route, p
+		}
+	}
+	if found == nil && fallback != nil {
+		found, params = fallback, fbParams
+	}
+	if len(allowed) > 0 {
+		allow("OPTIONS")
+	}
+	sort.Strings(allowed)
+	return found, params, allowed
+}
+
 func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if p := cleanPath(req.URL.Path); p != req.URL.Path {
 		sessionStart(w, req)
@@ -133,53 +390,113 @@ func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(http.StatusMovedPermanently)
 		return
 	}
-	var handler http.Handler
-	for _, route := range r.routes {
-		if route.method == "static" {
-			if route.staticMatch(req.URL.Path) {
-				handler = route.fn
-				break
-			}
-		}
-		if req.Method == route.method {
-			if route.match(req.URL.Path) {
-				handler = route.fn
-				break
-			}
+	realmReq := resolveRealm(req)
+	if realmReq == nil {
+		r.chain(http.NotFoundHandler()).ServeHTTP(w, req)
+		return
+	}
+	req = realmReq
+	route, params, allowed := r.lookup(req.Method, req.URL.Path)
+	if v, _, versioned := pathVersion(req.URL.Path); versioned {
+		req = withVersion(req, v)
+	} else if route == nil && len(allowed) == 0 {
+		// No unversioned route: serve the path under the version the
+		// client asked for in Accept-Version.
+		v, ok := negotiateVersion(req)
+		if !ok {
+			http.Error(w, "unsupported API version", http.StatusNotAcceptable)
+			return
 		}
+		url := *req.URL
+		url.Path = fmt.Sprintf("/v%s%s", v.name, req.URL.Path)
+		req.URL = &url
+		req = withVersion(req, v)
+		route, params, allowed = r.lookup(req.Method, req.URL.Path)
 	}
-	if handler == nil {
+	ctx := context.WithValue(req.Context(), allowedKey, allowed)
+	var handler http.Handler
+	switch {
+	case route != nil:
+		ctx = context.WithValue(ctx, routeKey, route)
+		ctx = context.WithValue(ctx, paramsKey, params)
+		handler = route.fn
+	case req.Method == "OPTIONS" && len(allowed) > 0:
+		handler = allowHandler(allowed, http.StatusNoContent)
+	case len(allowed) > 0:
+		handler = allowHandler(allowed, http.StatusMethodNotAllowed)
+	default:
 		handler = http.NotFoundHandler()
 	}
 
-	handler.ServeHTTP(w, req)
+	r.chain(handler).ServeHTTP(w, req.WithContext(ctx))
+}
+
+// allowHandler answers with the Allow header, for OPTIONS requests and
+// for methods the path does not accept.
+func allowHandler(allowed []string, status int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		if status == http.StatusNoContent {
+			w.WriteHeader(status)
+			return
+		}
+		http.Error(w, http.StatusText(status), status)
+	})
 }
 
 func createRouters(s service.Service) *Router {
 	r := newRouter()
+	r.Use(instrument, recoverer, requestIDs, accessLog, localize, versionHeaders, cors, authorize)
 	m := map[string]map[string]httpHandler{
 		"POST": {
-			"/token": TokenHandle,
-			"/reset": Reset,
+			"/token":                    TokenHandle,
+			"/logout":                   Logout,
+			"/reset":                    Reset,
+			"/challenge":                Challenge,
+			"/keys":                     RegisterKey,
+			"/webauthn/register/begin":  WebauthnRegisterBegin,
+			"/webauthn/register/finish": WebauthnRegisterFinish,
+			"/webauthn/login/begin":     WebauthnLoginBegin,
 		},
 		"GET": {
-			"/version": Version,
+			"/version":                 Version,
+			"/audit":                   AuditQuery,
+			"/logins":                  Logins,
+			"/captcha":                 Captcha,
+			"/users/{username}/logins": Logins,
+			"/versions":                Versions,
 		},
 		"static": {
 			"/file": Static,
 		},
 	}
 
+	scopes := map[string][]string{
+		"/reset": {scopeServiceRestart},
+		"/audit": {scopeAuditRead},
+	}
+
 	for method, routers := range m {
 		for router, handler := range routers {
-			r.HandleFunc(s, method, router, handler)
+			r.HandleFunc(s, method, router, handler, scopes[router]...)
+		}
+	}
+	r.HandleFuncReadOnly(s, "GET", "/verify", Verify)
+	if cfg.Daemon.TLS {
+		r.HandleFunc(s, "GET", "/ca", CACert)
+	}
+	r.Handle("GET", "/metrics", metricsHandler(true))
+	r.Handle("GET", "/healthz", http.HandlerFunc(Healthz))
+	r.Handle("GET", "/readyz", http.HandlerFunc(Readyz))
+	for _, c := range loadProxies() {
+		if err := r.HandleProxy(s, c); err != nil {
+			proxyLogger.Errorf("proxy %s:%s", c.Prefix, err.Error())
 		}
 	}
 	return r
 }
 
 func Static(s service.Service, w http.ResponseWriter, req *http.Request, session *Session) {
-	fmt.Println(http.Dir("./v1.0/file/"))
 	staticHandler := http.FileServer(http.Dir("./"))
 	staticHandler.ServeHTTP(w, req)
 	return
@@ -194,56 +511,70 @@ func Version(s service.Service, w http.ResponseWriter, req *http.Request, sessio
 	output(w, data)
 }
 
-func Reset(s service.Service, w http.ResponseWriter, req *http.Request, session *Session) {
-	data, params := decodeData(req)
-	if _, logined := session.container["username"]; logined {
-		password, ok := params["password"]
-		if ok {
-			if password == "123456" {
-				if err := s.Restart(); err != nil {
-					logger.Errorf("restart failed:%s", err.Error())
-					data.Code = "202"
-					data.Msg = "密码不正确"
-				} else {
-					logger.Info("restart success")
-					data.Code = "200"
-					data.Msg = "服务器重启成功"
-				}
-			}
-		} else if data.Code == "" {
-			data.Code = "301"
-			data.Msg = "参数不正确"
-		}
-	} else {
-		data.Code = "207"
-		data.Code = "请登录"
-	}
-	output(w, data)
+type resetRequest struct {
+	Password string `json:"password" validate:"max=256"`
+
+	// certificate is set for sessions authenticated by a client
+	// certificate, which restart without a password.
+	certificate bool
 }
 
-func decodeData(req *http.Request) (Rsp, map[string]string) {
-	var data Rsp
-	params := make(map[string]string)
-	str, err := ioutil.ReadAll(req.Body)
-	if err != nil {
-		logger.Info(err.Error())
-		data.Code = "100"
-		data.Msg = "系统错误"
-		return data, params
+func (r *resetRequest) validate() []fieldError {
+	if r.Password == "" && !r.certificate {
+		return []fieldError{{Field: "password", Rule: "required"}}
 	}
+	return nil
+}
 
-	if err := json.Unmarshal(str, &params); err != nil {
-		logger.Info(err.Error())
-		data.Code = "201"
-		data.Msg = "数据解析错误"
-		return data, params
+func Reset(s service.Service, w http.ResponseWriter, req *http.Request, session *Session) {
+	body := resetRequest{certificate: session.container["auth"] == authCertificate}
+	if !decodeRequest(w, req, &body) {
+		return
 	}
-	return data, params
+	username, logined := session.container["username"]
+	if !logined {
+		writeError(w, req, errLoginRequired, nil)
+		return
+	}
+	if _, ok := session.realm.checkPassword(username, body.Password); !ok && !body.certificate {
+		writeError(w, req, errWrongPassword, nil)
+		return
+	}
+	restart, err := prepareRestart(s)
+	if err != nil {
+		requestLogger(req).Errorf("restart failed:%s", err.Error())
+		audit.record(req, username, auditRestart, "", outcomeFailure)
+		restarts.inc(restartReset, outcomeFailure)
+		writeError(w, req, errRestartFailed, nil)
+		return
+	}
+	var data Rsp
+	data.Code = "200"
+	data.Msg = msg(req, "restarting")
+	output(w, data)
+	// Stopping drains in-flight requests, this one included, so the
+	// restart runs once the response is on its way.
+	go restart(func(err error) {
+		if err != nil {
+			requestLogger(req).Errorf("restart failed:%s", err.Error())
+			audit.record(req, username, auditRestart, "", outcomeFailure)
+			restarts.inc(restartReset, outcomeFailure)
+			return
+		}
+		requestLogger(req).Info("restart success")
+		audit.record(req, username, auditRestart, "", outcomeSuccess)
+		restarts.inc(restartReset, outcomeSuccess)
+	})
 }
 
 func output(w http.ResponseWriter, data interface{}) {
+	respond(w, http.StatusOK, data)
+}
+
+// respond is the single writer of API responses.
+func respond(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(status)
 	if ss, err := json.Marshal(data); err != nil {
 		logger.Error(err.Error())
 		panic(err.Error())
@@ -252,25 +583,126 @@ func output(w http.ResponseWriter, data interface{}) {
 	}
 }
 
+// tokenRequest carries one of a password, a signed challenge or a
+// WebAuthn assertion.
+type tokenRequest struct {
+	Username          string `json:"username" validate:"max=64"`
+	Password          string `json:"password" validate:"max=256"`
+	Scope             string `json:"scope" validate:"max=256"`
+	OTP               string `json:"otp" validate:"pattern=^[0-9]{6}$"`
+	Remember          string `json:"remember" validate:"pattern=^(true|false)$"`
+	CaptchaID         string `json:"captcha_id" validate:"max=64"`
+	CaptchaAnswer     string `json:"captcha_answer" validate:"max=16"`
+	ChallengeID       string `json:"challenge_id" validate:"max=64"`
+	Signature         string `json:"signature" validate:"max=1024"`
+	CredentialID      string `json:"credential_id" validate:"max=1024"`
+	ClientDataJSON    string `json:"client_data_json" validate:"max=4096"`
+	AuthenticatorData string `json:"authenticator_data" validate:"max=4096"`
+}
+
+func (r *tokenRequest) validate() []fieldError {
+	var errs []fieldError
+	if r.AuthenticatorData == "" && r.Username == "" {
+		errs = append(errs, fieldError{Field: "username", Rule: "required"})
+	}
+	if r.Password == "" && r.Signature == "" {
+		errs = append(errs, fieldError{Field: "password", Rule: "required"})
+	}
+	return errs
+}
+
 func TokenHandle(s service.Service, w http.ResponseWriter, req *http.Request, session *Session) {
-	data, params := decodeData(req)
-	var username, password string
-	var ok bool
-	username, ok = params["username"]
-	password, ok = params["password"]
-	if ok {
-		if username == "admin" && password == "123456" {
-			data.Code = "200"
-			data.Msg = "登录成功"
-			session.set("username", username)
-		} else {
-			data.Code = "202"
-			data.Msg = "用户名或密码错误"
-		}
-	} else if data.Code == "" {
-		data.Code = "301"
-		data.Msg = "参数不正确"
+	var body tokenRequest
+	if !decodeRequest(w, req, &body) {
+		return
+	}
+	if captchas.required(remoteIP(req)) && !captchas.solve(body.CaptchaID, body.CaptchaAnswer) {
+		writeError(w, req, errCaptchaRequired, challengeObject())
+		return
+	}
+	var u *user
+	var valid bool
+	if body.AuthenticatorData != "" {
+		u, valid = checkAssertion(session, &body)
+	} else if body.Signature != "" {
+		u, valid = checkSignature(session.realm, body.Username, body.ChallengeID, body.Signature)
+	} else {
+		u, valid = session.realm.checkPassword(body.Username, body.Password)
+	}
+	if !valid {
+		loginFailed(req, body.Username)
+		writeError(w, req, errCredentials, nil)
+		return
+	}
+	data, apiErr := loginUser(req, session, u, &body)
+	if apiErr != nil {
+		writeError(w, req, apiErr, nil)
+		return
 	}
+	if body.Remember == "true" {
+		remember(w, session)
+	}
+	output(w, data)
+}
+
+// loginUser finishes a login for an authenticated user: it enforces the
+// second factor for new devices, grants scopes and records the login.
+func loginUser(req *http.Request, session *Session, u *user, body *tokenRequest) (Rsp, *apiError) {
+	var data Rsp
+	history := session.realm.history
+	newDevice := history.isNewDevice(u.username, req)
+	if newDevice && liveConfig().Daemon.NewDevice2FA && u.totpSecret != "" && !session.realm.totp.check(u, body.OTP) {
+		history.add(u.username, req, false, true)
+		captchas.fail(remoteIP(req))
+		audit.record(req, u.username, auditLoginFailed, "otp", outcomeFailure)
+		logins.inc(outcomeFailure)
+		return data, errOTPRequired
+	}
+	granted := grantScopes(body.Scope, u.roles)
+	data.Code = "200"
+	data.Msg = msg(req, "login_success")
+	data.Object = map[string]string{
+		"scope": strings.Join(granted, " "),
+		"token": session.token(),
+	}
+	session.set("username", u.username)
+	session.set("scope", strings.Join(granted, " "))
+	history.add(u.username, req, true, newDevice)
+	captchas.reset(remoteIP(req))
+	audit.record(req, u.username, auditLogin, "", outcomeSuccess)
+	logins.inc(outcomeSuccess)
+	if newDevice {
+		requestLogger(req).Warningf("new device login for %s from %s (%s)", u.username, remoteIP(req), req.UserAgent())
+		audit.record(req, u.username, auditNewDevice, fingerprint(req), outcomeSuccess)
+	}
+	return data, nil
+}
+
+// loginFailed records a failed login attempt for username.
+func loginFailed(req *http.Request, username string) {
+	r := realmOf(req)
+	if _, exists := r.findUser(username); exists {
+		r.history.add(username, req, false, false)
+	}
+	captchas.fail(remoteIP(req))
+	audit.record(req, username, auditLoginFailed, "", outcomeFailure)
+	logins.inc(outcomeFailure)
+}
+
+// Logout ends the session's login and the remember-me login it may have
+// come from.
+func Logout(s service.Service, w http.ResponseWriter, req *http.Request, session *Session) {
+	username, logined := session.container["username"]
+	if !logined {
+		writeError(w, req, errLoginRequired, nil)
+		return
+	}
+	forget(w, req, session)
+	session.logout()
+	audit.record(req, username, auditLogout, "", outcomeSuccess)
+	var data Rsp
+	data.Code = "200"
+	data.Msg = msg(req, "logged_out")
 	output(w, data)
 }
 
@@ -292,6 +724,7 @@ func cleanPath(p string) string {
 
 type Rsp struct {
 	Code   string
+	Key    string `json:",omitempty"`
 	Msg    string
 	Object interface{}
 }
@@ -305,9 +738,35 @@ type Rsp struct {
 func main() {
 	//svcFlag := flag.String("service", "", "Control the system service.")
 	flag.Parse()
+	args := flag.Args()
+
+	var err error
+	cfg, err = configLoader.Load()
+	if len(args) == 2 && args[0] == "config" && args[1] == "check" {
+		if cfg != nil {
+			err = cfg.Check(os.Stdout, "daemon")
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err != nil {
+		logger.Fatal(err)
+	}
+	live.Store(cfg)
+	applyLogSettings(cfg)
+	if len(args) >= 2 && args[0] == "tls" && args[1] == "export-ca" {
+		if err := exportCA(strings.Join(args[2:], "")); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	svcConfig := &service.Config{
-		Name:        "daemon",
+		Name:        cfg.Daemon.ServiceName,
 		DisplayName: "Go Service Test",
 		Description: "This is a test Go service.",
 	}
@@ -315,23 +774,30 @@ func main() {
 	prg := &program{}
 	s, err := service.New(prg, svcConfig)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err)
 	}
 	errs := make(chan error, 5)
-	logger, err = s.Logger(errs)
+	svcLogger, err := s.Logger(errs)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err)
+	}
+	if underService() {
+		// Log to the log file when one is set, else to the service
+		// manager.
+		c := cfg.Daemon
+		logFile = logger.ServiceOutput(svcLogger, c.LogFile, config.Rotation(c.LogMaxSize, c.LogMaxAge, c.LogMaxBackups))
+		defer logFile.Close()
 	}
 
 	go func() {
 		for {
 			err := <-errs
 			if err != nil {
-				log.Print(err)
+				// Not through logger, which would forward it again.
+				fmt.Fprintln(os.Stderr, err)
 			}
 		}
 	}()
-	args := flag.Args()
 
 	if len(args) == 1 {
 		err := service.Control(s, args[0])
@@ -343,8 +809,8 @@ func main() {
 				s.Install()
 				s.Stop()
 			} else {
-				log.Printf("Valid actions: %q\n", service.ControlAction)
-				log.Fatal(err)
+				logger.Errorf("valid actions: %q", service.ControlAction)
+				logger.Fatal(err)
 			}
 		}
 		return
@@ -355,33 +821,3 @@ func main() {
 		logger.Error(err)
 	}
 }
-
-func createPipeServer() {
-	ln, err := npipe.Listen(common.PipeAddr)
-	if err != nil {
-		log.Fatal(err.Error())
-	}
-
-	go func() {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				log.Print(err.Error())
-				continue
-			}
-
-			// handle connection like any other net.Conn
-			go func(conn net.Conn) {
-				defer conn.Close()
-				r := bufio.NewReader(conn)
-				msg, err := r.ReadString('\n')
-				if err != nil {
-					log.Print(err.Error())
-					return
-				}
-				fmt.Fprint(conn, "heeelo\n")
-				fmt.Println(msg)
-			}(conn)
-		}
-	}()
-}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var metricsLogger = logger.With("component", "metrics")
+
+// Metrics are exposed on /metrics in the Prometheus text format. The
+// few metric types needed are implemented here rather than pulling in
+// the client library.
+var (
+	httpRequests = newCounterVec("simpleauth_http_requests_total",
+		"HTTP requests by route, method and status code.", "route", "method", "code")
+	httpDuration = newHistogramVec("simpleauth_http_request_duration_seconds",
+		"HTTP request latency by route and method.", "route", "method")
+	logins = newCounterVec("simpleauth_logins_total",
+		"Login attempts by result.", "result")
+	sessionOps = newCounterVec("simpleauth_session_store_operations_total",
+		"Session store operations by operation and result.", "op", "result")
+	restarts = newCounterVec("simpleauth_restarts_total",
+		"Restarts by cause, reset or upgrade, and result.", "cause", "result")
+
+	collectors = []collector{httpRequests, httpDuration, logins, sessionOps, restarts, activeSessions, runtimeCollector{}}
+
+	startTime = time.Now()
+)
+
+// Causes of restarts: the Reset API or SIGUSR2 after an upgrade.
+const (
+	restartReset   = "reset"
+	restartUpgrade = "upgrade"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the latency
+// histogram buckets.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type collector interface {
+	collect(w io.Writer)
+}
+
+// counterVec is a counter per combination of label values.
+type counterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) inc(values ...string) {
+	key := strings.Join(values, "\xff")
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) collect(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labelPairs(c.labels, key, ""), formatFloat(c.values[key]))
+	}
+}
+
+// histogramVec is a histogram per combination of label values.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, values: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	b, ok := h.values[key]
+	if !ok {
+		b = &histogram{counts: make([]uint64, len(durationBuckets))}
+		h.values[key] = b
+	}
+	for i, upper := range durationBuckets {
+		if v <= upper {
+			b.counts[i]++
+		}
+	}
+	b.count++
+	b.sum += v
+}
+
+func (h *histogramVec) collect(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		b := h.values[key]
+		for i, upper := range durationBuckets {
+			le := `le="` + formatFloat(upper) + `"`
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, key, le), b.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, key, `le="+Inf"`), b.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelPairs(h.labels, key, ""), formatFloat(b.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelPairs(h.labels, key, ""), b.count)
+	}
+}
+
+// sessionTracker counts the logged in sessions used within the session
+// TTL, which the session store does not report itself; the anonymous
+// sessions every visitor gets are left out. Sessions are dropped on logout
+// and swept once past the TTL, as the store expires them. It also finds
+// the sessions of a user, which the store cannot list.
+type sessionTracker struct {
+	mu   sync.Mutex
+	seen map[string]trackedSession
+}
+
+type trackedSession struct {
+	realm    *realm
+	username string
+	at       time.Time
+}
+
+var activeSessions = &sessionTracker{seen: make(map[string]trackedSession)}
+
+func (t *sessionTracker) touch(s *Session) {
+	username := s.container["username"]
+	if username == "" {
+		t.forget(s.sid)
+		return
+	}
+	t.mu.Lock()
+	t.seen[s.sid] = trackedSession{realm: s.realm, username: username, at: time.Now()}
+	t.mu.Unlock()
+}
+
+// forget drops a session that was logged out.
+func (t *sessionTracker) forget(sid string) {
+	t.mu.Lock()
+	delete(t.seen, sid)
+	t.mu.Unlock()
+}
+
+// ofUser returns the IDs of the sessions logged in as username in r.
+func (t *sessionTracker) ofUser(r *realm, username string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var sids []string
+	for sid, s := range t.seen {
+		if s.realm == r && s.username == username {
+			sids = append(sids, sid)
+		}
+	}
+	return sids
+}
+
+// sweep drops the sessions unused for longer than the session TTL.
+func (t *sessionTracker) sweep() {
+	ttl := time.Duration(liveConfig().Daemon.SessionTTL)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for sid, s := range t.seen {
+		if time.Since(s.at) > ttl {
+			delete(t.seen, sid)
+		}
+	}
+}
+
+func (t *sessionTracker) collect(w io.Writer) {
+	t.sweep()
+	t.mu.Lock()
+	n := len(t.seen)
+	t.mu.Unlock()
+	fmt.Fprintf(w, "# HELP simpleauth_sessions_active Sessions used within the session TTL.\n# TYPE simpleauth_sessions_active gauge\nsimpleauth_sessions_active %d\n", n)
+}
+
+// runtimeCollector reports Go runtime and process statistics.
+type runtimeCollector struct{}
+
+func (runtimeCollector) collect(w io.Writer) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	metric := func(name, typ, help string, v float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, typ, name, formatFloat(v))
+	}
+	metric("go_goroutines", "gauge", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	metric("go_memstats_alloc_bytes", "gauge", "Number of bytes allocated and still in use.", float64(ms.Alloc))
+	metric("go_memstats_heap_objects", "gauge", "Number of allocated objects.", float64(ms.HeapObjects))
+	metric("go_memstats_sys_bytes", "gauge", "Number of bytes obtained from the system.", float64(ms.Sys))
+	metric("go_gc_pause_seconds_total", "counter", "Total time spent in GC pauses.", float64(ms.PauseTotalNs)/1e9)
+	metric("go_gc_cycles_total", "counter", "Number of completed GC cycles.", float64(ms.NumGC))
+	metric("process_start_time_seconds", "gauge", "Start time of the process since unix epoch in seconds.", float64(startTime.UnixNano())/1e9)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// labelPairs formats the label values joined in key, plus extra, as
+// {name="value",...}.
+func labelPairs(names []string, key, extra string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, names[i]+`="`+escapeLabel(v)+`"`)
+		}
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// instrument counts requests and their latency by route. Requests that
+// match no route are counted under "unmatched", so that scanning for
+// paths does not create a series per path.
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, req)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		name := "unmatched"
+		if route := routeOf(req); route != nil {
+			name = route.path
+		}
+		httpRequests.inc(name, req.Method, strconv.Itoa(rec.status))
+		httpDuration.observe(time.Since(start).Seconds(), name, req.Method)
+	})
+}
+
+// metricsHandler writes every metric. On the main listener it is only
+// served when a metrics token is configured; the metrics listener also
+// requires the token when one is set.
+func metricsHandler(requireToken bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token := liveConfig().Daemon.MetricsToken
+		if token == "" && requireToken {
+			http.NotFound(w, req)
+			return
+		}
+		if token != "" {
+			got := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, c := range collectors {
+			c.collect(w)
+		}
+	})
+}
+
+// serveMetrics serves /metrics and the health checks on the metrics
+// listener until exit is closed. While a handoff drains, the previous
+// process may still hold the address, so binding is retried.
+func serveMetrics(exit chan struct{}) {
+	addr := cfg.Daemon.MetricsListen
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(false))
+	// Health checks are served here too, for load balancers that cannot
+	// present a client certificate to the main listener.
+	mux.HandleFunc("/healthz", Healthz)
+	mux.HandleFunc("/readyz", Readyz)
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-exit
+		srv.Close()
+	}()
+	for {
+		err := srv.ListenAndServe()
+		if err == http.ErrServerClosed {
+			return
+		}
+		metricsLogger.Warningf("metrics listener:%s", err.Error())
+		select {
+		case <-exit:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
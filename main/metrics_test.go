@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestActiveSessionsPruned(t *testing.T) {
+	srv := newTestServer(t)
+	activeSessions.mu.Lock()
+	activeSessions.seen = make(map[string]trackedSession)
+	activeSessions.mu.Unlock()
+	count := func() int {
+		activeSessions.mu.Lock()
+		defer activeSessions.mu.Unlock()
+		return len(activeSessions.seen)
+	}
+
+	c := newClient(t)
+	rsp := postJSON(t, c, srv.URL+"/v1.0/token", map[string]string{"username": "admin", "password": "wrong"})
+	if rsp.Code == "200" {
+		t.Fatalf("login with a wrong password: %+v", rsp)
+	}
+	if n := count(); n != 0 {
+		t.Fatalf("anonymous: %d sessions", n)
+	}
+	login(t, c, srv.URL)
+	if n := count(); n != 1 {
+		t.Fatalf("after login: %d sessions", n)
+	}
+	if rsp := postJSON(t, c, srv.URL+"/v1.0/logout", nil); rsp.Code != "200" {
+		t.Fatalf("logout: %+v", rsp)
+	}
+	if n := count(); n != 0 {
+		t.Fatalf("after logout: %d sessions", n)
+	}
+
+	activeSessions.mu.Lock()
+	activeSessions.seen["expired"] = trackedSession{at: time.Now().Add(-time.Duration(cfg.Daemon.SessionTTL) - time.Second)}
+	activeSessions.mu.Unlock()
+	activeSessions.sweep()
+	if n := count(); n != 0 {
+		t.Fatalf("after sweep: %d sessions", n)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golibs/uuid"
+	"github.com/liuzhiyi/daemon/logging"
+)
+
+var (
+	httpLogger   = logger.With("component", "http")
+	accessLogger = logger.With("component", "access")
+)
+
+// requestLogger returns the logger for messages about req, tagged with
+// its request ID.
+func requestLogger(req *http.Request) *logging.Logger {
+	return httpLogger.With("request_id", requestID(req))
+}
+
+// middleware wraps the handler of every request the Router dispatches.
+type middleware func(http.Handler) http.Handler
+
+// Use appends middlewares to the chain. The first one added is the
+// outermost.
+func (r *Router) Use(mw ...middleware) {
+	r.middlewares = append(r.middlewares, mw...)
+}
+
+func (r *Router) chain(h http.Handler) http.Handler {
+	for i := len(r.middlewares) - 1; i >= 0; i-- {
+		h = r.middlewares[i](h)
+	}
+	return h
+}
+
+// statusRecorder remembers the status and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hands the connection over, as for a WebSocket upgrade proxied
+// to an upstream, which is then recorded as 101 Switching Protocols.
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+// recoverer turns a panicking handler into a 500 response.
+func recoverer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				requestLogger(req).Log(logging.Error, fmt.Sprintf("panic serving %s %s: %v", req.Method, req.URL.Path, err), "stack", string(debug.Stack()))
+				writeError(w, req, errSystem, nil)
+			}
+		}()
+		next.ServeHTTP(w, req)
+	})
+}
+
+// requestIDs assigns every request an ID, taken from X-Request-ID when
+// the client sends a valid one, and echoes it in the response.
+func requestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = strings.Replace(uuid.Rand().Hex(), "-", "", -1)
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), requestIDKey, id)))
+	})
+}
+
+const maxRequestIDLength = 64
+
+// validRequestID reports whether a client's request ID is short and
+// made of letters, digits, '.', '_' and '-' only, so that it is safe to
+// copy into logs and responses.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// accessLog logs one line per request, in the Apache combined log
+// format or as structured fields. A request whose handler panics is
+// logged as a 500, which recoverer answers.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		completed := false
+		defer func() {
+			if rec.status == 0 && !completed {
+				rec.status = http.StatusInternalServerError
+			}
+			logAccess(req, rec, start)
+		}()
+		next.ServeHTTP(rec, req)
+		completed = true
+	})
+}
+
+func logAccess(req *http.Request, rec *statusRecorder, start time.Time) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if liveConfig().Daemon.AccessLogFormat == "structured" {
+		accessLogger.Log(logging.Info, "request",
+			"remote_ip", remoteIP(req),
+			"method", req.Method,
+			"uri", req.URL.RequestURI(),
+			"proto", req.Proto,
+			"status", rec.status,
+			"size", rec.size,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+			"referer", req.Referer(),
+			"user_agent", req.UserAgent(),
+			"request_id", requestID(req))
+		return
+	}
+	size := "-"
+	if rec.size > 0 {
+		size = strconv.Itoa(rec.size)
+	}
+	accessLogger.Log(logging.Info, fmt.Sprintf("%s - - [%s] %q %d %s %q %q",
+		remoteIP(req), start.Format("02/Jan/2006:15:04:05 -0700"),
+		req.Method+" "+req.URL.RequestURI()+" "+req.Proto,
+		rec.status, size, orDash(req.Referer()), orDash(req.UserAgent())),
+		"request_id", requestID(req))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// corsAllowed returns the Access-Control-Allow-Origin for origin, or ""
+// when it is not allowed. Origins listed by name get their own origin and
+// may send credentials; origins admitted only by * get a literal * and
+// may not, so that * never exposes the session cookie to every site.
+func corsAllowed(origin string) (allow string, credentials bool) {
+	for _, allowed := range strings.Split(liveConfig().Daemon.CorsOrigins, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" {
+			allow = "*"
+		} else if allowed != "" && strings.EqualFold(allowed, origin) {
+			return origin, true
+		}
+	}
+	return allow, false
+}
+
+// cors adds CORS headers for the origins in cors-origins and answers
+// preflight requests.
+func cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+		allow, credentials := corsAllowed(origin)
+		if origin == "" || allow == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		h.Set("Access-Control-Allow-Origin", allow)
+		if credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		h.Set("Access-Control-Expose-Headers", "X-Request-ID")
+		if req.Method == "OPTIONS" && req.Header.Get("Access-Control-Request-Method") != "" {
+			allowed, _ := req.Context().Value(allowedKey).([]string)
+			if len(allowed) == 0 {
+				next.ServeHTTP(w, req)
+				return
+			}
+			h.Set("Access-Control-Allow-Methods", strings.Join(allowed, ", "))
+			if headers := req.Header.Get("Access-Control-Request-Headers"); headers != "" {
+				h.Set("Access-Control-Allow-Headers", headers)
+			}
+			h.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// authorize enforces the scopes declared by the matched route, logging
+// the session in from a remember-me cookie first when needed.
+func authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		route := routeOf(req)
+		if route == nil || len(route.scopes) == 0 {
+			next.ServeHTTP(w, req)
+			return
+		}
+		session, ok := resumeSession(w, req)
+		if !ok {
+			writeError(w, req, errLoginRequired, nil)
+			return
+		}
+		if !session.hasScopes(route.scopes) {
+			writeError(w, req, errForbidden, nil)
+			return
+		}
+		// The handler gets this session: a remember-me token is single
+		// use, so restoring it a second time would look like theft.
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), sessionKey, session)))
+	})
+}
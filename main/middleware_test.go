@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuthorizeRemembered(t *testing.T) {
+	srv := newTestServer(t)
+	remembered := cookieNamed(loginCookies(t, srv.URL, true), rememberName)
+
+	req, _ := http.NewRequest("GET", srv.URL+"/v1.0/audit", nil)
+	req.AddCookie(remembered[0])
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	var out testRsp
+	if err := json.NewDecoder(rsp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Code != "200" {
+		t.Fatalf("got %+v", out)
+	}
+	// The token was restored once, by authorize, and rotated once.
+	if n := len(cookieNamed(rsp.Cookies(), rememberName)); n != 1 {
+		t.Fatalf("cookies %v", rsp.Cookies())
+	}
+	if n := len(rsp.Header["Set-Cookie"]); n != 2 {
+		t.Fatalf("Set-Cookie %v", rsp.Header["Set-Cookie"])
+	}
+}
+
+func TestCorsWildcard(t *testing.T) {
+	srv := newTestServer(t)
+	c := *liveConfig()
+	c.Daemon.CorsOrigins = "https://app.example, *"
+	live.Store(&c)
+
+	for _, test := range []struct {
+		origin, allow, credentials string
+	}{
+		{"https://app.example", "https://app.example", "true"},
+		{"https://other.example", "*", ""},
+	} {
+		req, _ := http.NewRequest("GET", srv.URL+"/v1.0/version", nil)
+		req.Header.Set("Origin", test.origin)
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		if got := rsp.Header.Get("Access-Control-Allow-Origin"); got != test.allow {
+			t.Errorf("%s: Allow-Origin %q, want %q", test.origin, got, test.allow)
+		}
+		if got := rsp.Header.Get("Access-Control-Allow-Credentials"); got != test.credentials {
+			t.Errorf("%s: Allow-Credentials %q, want %q", test.origin, got, test.credentials)
+		}
+	}
+}
+
+func TestAuthorizeScopes(t *testing.T) {
+	srv := newTestServer(t)
+	for _, test := range []struct {
+		scope, path string
+		code        string
+	}{
+		{"audit:read", "/v1.0/audit", "200"},
+		{"version:read", "/v1.0/audit", errForbidden.Code},
+		{"audit:read version:read", "/v1.0/audit", "200"},
+		// Unscoped routes need no scope.
+		{"version:read", "/v1.0/versions", "200"},
+	} {
+		rsp := postJSON(t, newClient(t), srv.URL+"/v1.0/token", map[string]string{"username": "admin", "password": "123456", "scope": test.scope})
+		if rsp.Code != "200" {
+			t.Fatalf("login: %+v", rsp)
+		}
+		token, _ := rsp.Object["token"].(string)
+		if got := getWithToken(t, srv.URL+test.path, token); got.Code != test.code {
+			t.Errorf("%q %s: %+v", test.scope, test.path, got)
+		}
+	}
+	if got := getWithToken(t, srv.URL+"/v1.0/audit", "bogus.token"); got.Code != errLoginRequired.Code {
+		t.Errorf("bad token: %+v", got)
+	}
+}
+
+func TestRequestIDs(t *testing.T) {
+	for _, test := range []struct {
+		name, id string
+		kept     bool
+	}{
+		{"none", "", false},
+		{"valid", "req-1_2.3", true},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+		{"longest", strings.Repeat("a", maxRequestIDLength), true},
+		{"space", "req 1", false},
+		{"quote", `req"1`, false},
+		{"non-ASCII", "req\u00e91", false},
+	} {
+		var seen string
+		h := requestIDs(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			seen = requestID(req)
+		}))
+		req := httptest.NewRequest("GET", "/", nil)
+		if test.id != "" {
+			req.Header.Set("X-Request-ID", test.id)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		got := w.Header().Get("X-Request-ID")
+		if got != seen || !validRequestID(got) {
+			t.Errorf("%s: response %q, request %q", test.name, got, seen)
+		}
+		if (got == test.id) != test.kept {
+			t.Errorf("%s: got %q for %q, kept %v", test.name, got, test.id, !test.kept)
+		}
+	}
+}
+
+func TestAccessLogPanic(t *testing.T) {
+	newTestServer(t)
+	c := *liveConfig()
+	c.Daemon.AccessLogFormat = "structured"
+	live.Store(&c)
+	var out bytes.Buffer
+	logger.SetOutput(&out)
+	defer logger.SetOutput(ioutil.Discard)
+
+	h := recoverer(requestIDs(accessLog(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		panic("boom")
+	}))))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/v1.0/panics", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("code %d", w.Code)
+	}
+	var logged string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.Contains(line, "component=access") {
+			logged = line
+		}
+	}
+	if !strings.Contains(logged, "/v1.0/panics") || !strings.Contains(logged, "status=500") {
+		t.Fatalf("access log %q in\n%s", logged, out.String())
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+
+	"github.com/liuzhiyi/daemon/common"
+	"github.com/natefinch/npipe"
+)
+
+func createPipeServer() {
+	pipeLogger := logger.With("component", "pipe")
+	ln, err := npipe.Listen(common.PipeAddr)
+	if err != nil {
+		pipeLogger.Fatal(err.Error())
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				pipeLogger.Error(err.Error())
+				continue
+			}
+
+			// handle connection like any other net.Conn
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				msg, err := r.ReadString('\n')
+				if err != nil {
+					pipeLogger.Error(err.Error())
+					return
+				}
+				fmt.Fprint(conn, "heeelo\n")
+				pipeLogger.Debugf("received %q", msg)
+			}(conn)
+		}
+	}()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kardianos/service"
+)
+
+var proxyLogger = logger.With("component", "proxy")
+
+const proxiesFile = "proxies.json"
+
+// proxyConfig maps a path prefix to an upstream service. Only sessions
+// holding one of Roles, or any logged in session when Roles is empty, are
+// forwarded.
+type proxyConfig struct {
+	Prefix      string   `json:"prefix"`
+	Upstream    string   `json:"upstream"`
+	Roles       []string `json:"roles"`
+	StripPrefix bool     `json:"strip_prefix"`
+}
+
+// loadProxies reads the proxy table from proxies.json in the working
+// directory.
+func loadProxies() []proxyConfig {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = "./"
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(dir, proxiesFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			proxyLogger.Errorf("proxies:%s", err.Error())
+		}
+		return nil
+	}
+	var configs []proxyConfig
+	if err := json.Unmarshal(buf, &configs); err != nil {
+		proxyLogger.Errorf("proxies:%s", err.Error())
+		return nil
+	}
+	return configs
+}
+
+// proxyMatch matches path against the route's prefix on a path segment
+// boundary, so /app matches /app and /app/x but not /apps.
+func (r *route) proxyMatch(path string) bool {
+	return path == r.path || strings.HasPrefix(path, strings.TrimSuffix(r.path, "/")+"/")
+}
+
+// HandleProxy registers an authenticating reverse proxy for c.
+func (r *Router) HandleProxy(s service.Service, c proxyConfig) error {
+	if c.Prefix == "" || c.Prefix[0] != '/' || c.Prefix == "/" {
+		return errors.New("proxy prefix must be a path below /")
+	}
+	target, err := url.Parse(c.Upstream)
+	if err != nil {
+		return err
+	}
+	if target.Scheme == "" || target.Host == "" {
+		return errors.New("proxy upstream must be an absolute URL")
+	}
+	route := r.newRoute()
+	route.method = "proxy"
+	route.path = cleanPath(c.Prefix)
+	route.roles = c.Roles
+	route.fn = newAuthProxy(route.path, target, c)
+	return nil
+}
+
+func hasRole(u *user, roles []string) bool {
+	if len(roles) == 0 {
+		return true
+	}
+	for _, want := range roles {
+		for _, role := range u.roles {
+			if role == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stripCookies removes the daemon's own cookies from header, leaving the
+// upstream's cookies alone.
+func stripCookies(header http.Header, r *realm) {
+	req := http.Request{Header: http.Header{"Cookie": header["Cookie"]}}
+	var kept []string
+	for _, c := range req.Cookies() {
+		if c.Name != r.cookieName && c.Name != r.rememberName {
+			kept = append(kept, c.String())
+		}
+	}
+	header.Del("Cookie")
+	if len(kept) > 0 {
+		header.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
+
+func newAuthProxy(prefix string, target *url.URL, c proxyConfig) http.Handler {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		if c.StripPrefix {
+			req.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, prefix), "/")
+			req.URL.RawPath = ""
+		}
+		director(req)
+		req.Host = target.Host
+	}
+	proxy.ModifyResponse = func(rsp *http.Response) error {
+		// Upstreams must not overwrite the daemon's cookies.
+		r := realmOf(rsp.Request)
+		var kept []string
+		for _, line := range rsp.Header["Set-Cookie"] {
+			name := strings.TrimSpace(strings.SplitN(line, "=", 2)[0])
+			if name != r.cookieName && name != r.rememberName {
+				kept = append(kept, line)
+			}
+		}
+		rsp.Header["Set-Cookie"] = kept
+		return nil
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		session, ok := resumeSession(w, req)
+		var u *user
+		if ok {
+			u, ok = session.realm.findUser(session.container["username"])
+		}
+		if !ok {
+			unauthorized(w, req, req.URL.RequestURI())
+			return
+		}
+		if !hasRole(u, c.Roles) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		out := req.Clone(req.Context())
+		stripCookies(out.Header, session.realm)
+		// A session token is the daemon's; other credentials are the
+		// upstream's.
+		if _, ok := session.realm.verify(bearerToken(req)); ok {
+			out.Header.Del("Authorization")
+		}
+		for name := range out.Header {
+			if strings.HasPrefix(http.CanonicalHeaderKey(name), "X-Auth-") {
+				out.Header.Del(name)
+			}
+		}
+		out.Header.Set("X-Auth-User", u.username)
+		out.Header.Set("X-Auth-Roles", strings.Join(u.roles, ","))
+		out.Header.Set("X-Auth-Realm", session.realm.name)
+		proxy.ServeHTTP(w, out)
+	})
+}
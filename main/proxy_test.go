@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyRemembered(t *testing.T) {
+	srv := newTestServer(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, req.Header.Get("X-Auth-User"))
+	}))
+	defer upstream.Close()
+	r := createRouters(nil)
+	if err := r.HandleProxy(nil, proxyConfig{Prefix: "/app", Upstream: upstream.URL}); err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(r)
+	defer proxy.Close()
+
+	get := func(cookies []*http.Cookie) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", proxy.URL+"/app/", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		body, _ := io.ReadAll(rsp.Body)
+		return rsp, string(body)
+	}
+
+	if rsp, _ := get(nil); rsp.StatusCode != http.StatusUnauthorized || len(rsp.Cookies()) != 0 {
+		t.Fatalf("anonymous: status %d, cookies %v", rsp.StatusCode, rsp.Cookies())
+	}
+
+	// A browser holding only the remember-me cookie is logged back in,
+	// and given a session and a new remember-me token.
+	remembered := cookieNamed(loginCookies(t, srv.URL, true), rememberName)
+	rsp, user := get(remembered)
+	if rsp.StatusCode != http.StatusOK || user != "admin" {
+		t.Fatalf("remembered: status %d, user %q", rsp.StatusCode, user)
+	}
+	session := cookieNamed(rsp.Cookies(), sessionName)
+	rotated := cookieNamed(rsp.Cookies(), rememberName)
+	if session == nil || rotated == nil || rotated[0].Value == remembered[0].Value {
+		t.Fatalf("cookies %v", rsp.Cookies())
+	}
+	if rsp, user := get(session); rsp.StatusCode != http.StatusOK || user != "admin" {
+		t.Fatalf("session: status %d, user %q", rsp.StatusCode, user)
+	}
+}
+
+// newTestProxy serves the daemon's routes with /app proxied to upstream.
+func newTestProxy(t *testing.T, upstream http.Handler) (srv, proxy *httptest.Server) {
+	t.Helper()
+	srv = newTestServer(t)
+	up := httptest.NewServer(upstream)
+	t.Cleanup(up.Close)
+	r := createRouters(nil)
+	if err := r.HandleProxy(nil, proxyConfig{Prefix: "/app", Upstream: up.URL}); err != nil {
+		t.Fatal(err)
+	}
+	proxy = httptest.NewServer(r)
+	t.Cleanup(proxy.Close)
+	return srv, proxy
+}
+
+func TestProxyAuthorization(t *testing.T) {
+	srv, proxy := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, req.Header.Get("Authorization"))
+	}))
+	token, _ := login(t, newClient(t), srv.URL).Object["token"].(string)
+	session := cookieNamed(loginCookies(t, srv.URL, false), sessionName)
+
+	for _, test := range []struct {
+		name, auth string
+		cookies    []*http.Cookie
+		forwarded  string
+	}{
+		{"session token", "Bearer " + token, nil, ""},
+		{"upstream credentials", "Basic dXNlcjpwYXNz", session, "Basic dXNlcjpwYXNz"},
+	} {
+		req, _ := http.NewRequest("GET", proxy.URL+"/app/", nil)
+		req.Header.Set("Authorization", test.auth)
+		for _, c := range test.cookies {
+			req.AddCookie(c)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if rsp.StatusCode != http.StatusOK || string(body) != test.forwarded {
+			t.Errorf("%s: status %d, forwarded %q, want %q", test.name, rsp.StatusCode, body, test.forwarded)
+		}
+	}
+}
+
+func TestProxyUpgrade(t *testing.T) {
+	srv, proxy := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Upgrade") != "echo" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		buf.Flush()
+		line, _ := buf.ReadString('\n')
+		buf.WriteString(line)
+		buf.Flush()
+	}))
+	session := cookieNamed(loginCookies(t, srv.URL, false), sessionName)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET /app/ HTTP/1.1\r\nHost: app\r\nConnection: Upgrade\r\nUpgrade: echo\r\nCookie: %s\r\n\r\n", session[0].String())
+	r := bufio.NewReader(conn)
+	rsp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d", rsp.StatusCode)
+	}
+	io.WriteString(conn, "ping\n")
+	if line, err := r.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Fatalf("echo %q, %v", line, err)
+	}
+}
+
+func TestProxyStreaming(t *testing.T) {
+	release := make(chan struct{})
+	srv, proxy := newTestProxy(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer close(release)
+	session := cookieNamed(loginCookies(t, srv.URL, false), sessionName)
+
+	req, _ := http.NewRequest("GET", proxy.URL+"/app/", nil)
+	req.AddCookie(session[0])
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	// The first event arrives while the upstream is still writing.
+	line, err := bufio.NewReader(rsp.Body).ReadString('\n')
+	if err != nil || line != "data: first\n" {
+		t.Fatalf("got %q, %v", line, err)
+	}
+}
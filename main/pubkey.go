@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golibs/uuid"
+	"github.com/kardianos/service"
+)
+
+var keysLogger = logger.With("component", "keys")
+
+const (
+	keysPath             = "/keys.json"
+	challengeExpiration  = 2 * time.Minute
+	challengeNonceLength = 32
+	// maxKeyChallenges bounds the outstanding challenges of a realm,
+	// key and WebAuthn challenges each, which anyone can request. When
+	// full, the oldest gives way.
+	maxKeyChallenges = 10000
+
+	auditKeyRegister = "key.register"
+)
+
+type keyChallenge struct {
+	username string
+	nonce    []byte
+	expires  time.Time
+}
+
+// keyStore holds the registered ed25519 public keys of every user and the
+// outstanding login challenges.
+type keyStore struct {
+	mu         sync.Mutex
+	path       string
+	keys       map[string][]string
+	challenges map[string]*keyChallenge
+}
+
+func newKeyStore() *keyStore {
+	return &keyStore{
+		keys:       make(map[string][]string),
+		challenges: make(map[string]*keyChallenge),
+	}
+}
+
+// load reads the keys kept in dir and saves there from now on.
+func (k *keyStore) load(dir string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.path = filepath.Join(dir, keysPath)
+	buf, err := ioutil.ReadFile(k.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			keysLogger.Errorf("public keys:%s", err.Error())
+		}
+		return
+	}
+	if err := json.Unmarshal(buf, &k.keys); err != nil {
+		keysLogger.Errorf("public keys:%s", err.Error())
+	}
+}
+
+// close stops saving the keys; registering one fails from then on.
+func (k *keyStore) close() {
+	k.mu.Lock()
+	k.path = ""
+	k.mu.Unlock()
+}
+
+func (k *keyStore) save() error {
+	if k.path == "" {
+		return errStoreClosed
+	}
+	buf, err := json.Marshal(k.keys)
+	if err != nil {
+		return err
+	}
+	tmp := k.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, k.path)
+}
+
+func (k *keyStore) register(username string, pub ed25519.PublicKey) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	encoded := base64.StdEncoding.EncodeToString(pub)
+	for _, existing := range k.keys[username] {
+		if existing == encoded {
+			return nil
+		}
+	}
+	k.keys[username] = append(k.keys[username], encoded)
+	return k.save()
+}
+
+// challenge issues a nonce for username. Challenges are issued for unknown
+// users as well so that they cannot be told apart.
+func (k *keyStore) challenge(username string) (string, []byte) {
+	nonce := make([]byte, challengeNonceLength)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err.Error())
+	}
+	id := strings.Replace(uuid.Rand().Hex(), "-", "", -1)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.challenges) >= maxKeyChallenges {
+		k.sweepLocked()
+	}
+	if len(k.challenges) >= maxKeyChallenges {
+		var oldest string
+		for key, c := range k.challenges {
+			if oldest == "" || c.expires.Before(k.challenges[oldest].expires) {
+				oldest = key
+			}
+		}
+		delete(k.challenges, oldest)
+	}
+	k.challenges[id] = &keyChallenge{username: username, nonce: nonce, expires: time.Now().Add(challengeExpiration)}
+	return id, nonce
+}
+
+// sweep drops expired challenges.
+func (k *keyStore) sweep() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.sweepLocked()
+}
+
+func (k *keyStore) sweepLocked() {
+	now := time.Now()
+	for key, c := range k.challenges {
+		if now.After(c.expires) {
+			delete(k.challenges, key)
+		}
+	}
+}
+
+// challengeMessage is what the client signs: the nonce bound to the user
+// and to this protocol.
+func challengeMessage(username string, nonce []byte) []byte {
+	return []byte("simpleauth-login\n" + username + "\n" + base64.StdEncoding.EncodeToString(nonce))
+}
+
+// checkSignature verifies a signed challenge. The challenge is consumed
+// whatever the outcome.
+func checkSignature(r *realm, username, id, signature string) (*user, bool) {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, false
+	}
+	keys := r.keys
+	keys.mu.Lock()
+	c, ok := keys.challenges[id]
+	delete(keys.challenges, id)
+	registered := keys.keys[username]
+	keys.mu.Unlock()
+	if !ok || c.username != username || time.Now().After(c.expires) {
+		return nil, false
+	}
+	u, ok := r.findUser(username)
+	if !ok {
+		return nil, false
+	}
+	msg := challengeMessage(username, c.nonce)
+	for _, encoded := range registered {
+		pub, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			continue
+		}
+		if ed25519.Verify(ed25519.PublicKey(pub), msg, sig) {
+			return u, true
+		}
+	}
+	return nil, false
+}
+
+type challengeRequest struct {
+	Username string `json:"username" validate:"required,max=64"`
+}
+
+func Challenge(s service.Service, w http.ResponseWriter, req *http.Request, session *Session) {
+	var body challengeRequest
+	if !decodeRequest(w, req, &body) {
+		return
+	}
+	id, nonce := realmOf(req).keys.challenge(body.Username)
+	var data Rsp
+	data.Code = "200"
+	data.Object = map[string]string{
+		"challenge_id": id,
+		"nonce":        base64.StdEncoding.EncodeToString(nonce),
+	}
+	output(w, data)
+}
+
+type registerKeyRequest struct {
+	Username string `json:"username" validate:"max=64"`
+	Password string `json:"password" validate:"max=256"`
+	// 32 bytes in standard base64.
+	PublicKey     string `json:"public_key" validate:"required,pattern=^[A-Za-z0-9+/]{43}=$"`
+	CaptchaID     string `json:"captcha_id" validate:"max=64"`
+	CaptchaAnswer string `json:"captcha_answer" validate:"max=16"`
+}
+
+// RegisterKey adds an ed25519 public key to the current user, or to the
+// user named in the request when the password is supplied with it. The
+// password is checked like a login: after repeated failures the captcha
+// must be solved, and failures count towards it.
+func RegisterKey(s service.Service, w http.ResponseWriter, req *http.Request, session *Session) {
+	var body registerKeyRequest
+	if !decodeRequest(w, req, &body) {
+		return
+	}
+	r := realmOf(req)
+	username, logined := session.container["username"]
+	if !logined {
+		if captchas.required(remoteIP(req)) && !captchas.solve(body.CaptchaID, body.CaptchaAnswer) {
+			writeError(w, req, errCaptchaRequired, challengeObject())
+			return
+		}
+		if _, valid := r.checkPassword(body.Username, body.Password); !valid {
+			loginFailed(req, body.Username)
+			writeError(w, req, errCredentials, nil)
+			return
+		}
+		captchas.reset(remoteIP(req))
+		username = body.Username
+	}
+	pub, err := base64.StdEncoding.DecodeString(body.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		writeError(w, req, errBadParams, nil)
+		return
+	}
+	if err := r.keys.register(username, ed25519.PublicKey(pub)); err != nil {
+		requestLogger(req).Error(err.Error())
+		audit.record(req, username, auditKeyRegister, username, outcomeFailure)
+		writeError(w, req, errSystem, nil)
+		return
+	}
+	audit.record(req, username, auditKeyRegister, username, outcomeSuccess)
+	var data Rsp
+	data.Code = "200"
+	data.Msg = msg(req, "key_registered")
+	output(w, data)
+}
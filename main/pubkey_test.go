@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+// registerKey registers a new ed25519 key for admin and returns it.
+func registerKey(t *testing.T, base string) ed25519.PrivateKey {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newClient(t)
+	login(t, c, base)
+	rsp := postJSON(t, c, base+"/v1.0/keys", map[string]string{"public_key": base64.StdEncoding.EncodeToString(pub)})
+	if rsp.Code != "200" {
+		t.Fatalf("register key: %+v", rsp)
+	}
+	return priv
+}
+
+// requestChallenge requests a challenge for username and returns its ID
+// and nonce.
+func requestChallenge(t *testing.T, base, username string) (string, []byte) {
+	t.Helper()
+	rsp := postRaw(t, base+"/v1.0/challenge", `{"username":"`+username+`"}`)
+	id, _ := rsp.Object["challenge_id"].(string)
+	encoded, _ := rsp.Object["nonce"].(string)
+	nonce, err := base64.StdEncoding.DecodeString(encoded)
+	if rsp.Code != "200" || id == "" || err != nil {
+		t.Fatalf("challenge: %+v", rsp)
+	}
+	return id, nonce
+}
+
+func TestKeyLogin(t *testing.T) {
+	srv := newTestServer(t)
+	priv := registerKey(t, srv.URL)
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signIn := func(id string, key ed25519.PrivateKey, signed []byte) testRsp {
+		return postJSON(t, newClient(t), srv.URL+"/v1.0/token", map[string]string{
+			"username":     "admin",
+			"challenge_id": id,
+			"signature":    base64.StdEncoding.EncodeToString(ed25519.Sign(key, signed)),
+		})
+	}
+
+	id, nonce := requestChallenge(t, srv.URL, "admin")
+	if rsp := signIn(id, priv, challengeMessage("admin", nonce)); rsp.Code != "200" {
+		t.Fatalf("login: %+v", rsp)
+	}
+
+	for _, test := range []struct {
+		name string
+		// username is who the challenge is requested for.
+		username string
+		key      ed25519.PrivateKey
+		expired  bool
+		replay   bool
+	}{
+		{"replayed", "admin", priv, false, true},
+		{"issued for another user", "guest", priv, false, false},
+		{"expired", "admin", priv, true, false},
+		{"unregistered key", "admin", other, false, false},
+	} {
+		id, nonce := requestChallenge(t, srv.URL, test.username)
+		signed := challengeMessage("admin", nonce)
+		if test.replay {
+			if rsp := signIn(id, priv, signed); rsp.Code != "200" {
+				t.Fatalf("%s: first use: %+v", test.name, rsp)
+			}
+		}
+		if test.expired {
+			keys := defaultRealm.keys
+			keys.mu.Lock()
+			keys.challenges[id].expires = time.Now().Add(-time.Second)
+			keys.mu.Unlock()
+		}
+		if rsp := signIn(id, test.key, signed); rsp.Code != errCredentials.Code {
+			t.Errorf("%s: got %+v, want code %s", test.name, rsp, errCredentials.Code)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+var realmLogger = logger.With("component", "realm")
+
+const (
+	defaultRealmName = "default"
+	realmsFile       = "realms.json"
+	realmsDir        = "/realms"
+	signingKeyFile   = "signing.key"
+)
+
+// realm is an isolated tenant: its own users, password policy, session
+// cookie and signing key, and its own per-user stores.
+type realm struct {
+	name         string
+	hosts        []string
+	cookieName   string
+	rememberName string
+	signingKey   []byte
+	policy       passwordPolicy
+	users        map[string]*user
+	clientCerts  map[string]certMapping
+
+	history     *loginHistory
+	keys        *keyStore
+	credentials *credentialStore
+	remembered  *rememberStore
+	totp        *totpSteps
+
+	webauthnChallenges *webauthnChallenges
+}
+
+type passwordPolicy struct {
+	MinLength     int  `json:"min_length"`
+	RequireLetter bool `json:"require_letter"`
+	RequireDigit  bool `json:"require_digit"`
+	RequireSymbol bool `json:"require_symbol"`
+}
+
+func (p passwordPolicy) check(password string) error {
+	if len(password) < p.MinLength {
+		return fmt.Errorf("password shorter than %d characters", p.MinLength)
+	}
+	var letter, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			letter = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	if p.RequireLetter && !letter {
+		return errors.New("password needs a letter")
+	}
+	if p.RequireDigit && !digit {
+		return errors.New("password needs a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		return errors.New("password needs a symbol")
+	}
+	return nil
+}
+
+type realmConfig struct {
+	Name       string         `json:"name"`
+	Hosts      []string       `json:"hosts"`
+	CookieName string         `json:"cookie_name"`
+	Policy     passwordPolicy `json:"password_policy"`
+	Users      []struct {
+		Username   string   `json:"username"`
+		Password   string   `json:"password"`
+		Roles      []string `json:"roles"`
+		TotpSecret string   `json:"totp_secret"`
+	} `json:"users"`
+	ClientCerts []certMapping `json:"client_certs"`
+}
+
+var (
+	defaultRealm = newRealm(defaultRealmName, sessionName, users)
+	realms       = map[string]*realm{defaultRealmName: defaultRealm}
+	// realmsMu guards realms and the users, hosts and policy of every
+	// realm, which are replaced on reload.
+	realmsMu sync.RWMutex
+	// realmsErr is why realms.json could not be applied on the last
+	// reload, reported by /readyz.
+	realmsErr error
+)
+
+func newRealm(name, cookieName string, users map[string]*user) *realm {
+	r := &realm{
+		name:         name,
+		cookieName:   cookieName,
+		rememberName: rememberName,
+		signingKey:   []byte(randomHex(32)),
+		users:        users,
+		history:      newLoginHistory(),
+		keys:         newKeyStore(),
+		credentials:  newCredentialStore(),
+		remembered:   newRememberStore(),
+		totp:         newTOTPSteps(),
+
+		webauthnChallenges: newWebauthnChallenges(),
+	}
+	if name != defaultRealmName {
+		r.rememberName = cookieName + "_" + rememberName
+	}
+	return r
+}
+
+// load reads the realm's stores and signing key from dir, creating the
+// key on first use.
+func (r *realm) load(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	keyPath := filepath.Join(dir, signingKeyFile)
+	key, err := ioutil.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		key = []byte(randomHex(32))
+		err = ioutil.WriteFile(keyPath, key, 0600)
+	}
+	if err != nil {
+		return err
+	}
+	r.signingKey = key
+	r.history.load(dir)
+	r.keys.load(dir)
+	r.credentials.load(dir)
+	r.remembered.load(dir)
+	return nil
+}
+
+var errStoreClosed = errors.New("store closed")
+
+// close stops the realm's stores from saving, so that a process taking
+// over the daemon's files reads them as they are and nothing overwrites
+// them.
+func (r *realm) close() {
+	r.history.close()
+	r.keys.close()
+	r.credentials.close()
+	r.remembered.close()
+}
+
+// closeRealms closes the stores of every realm.
+func closeRealms() {
+	realmsMu.RLock()
+	defer realmsMu.RUnlock()
+	for _, r := range realms {
+		r.close()
+	}
+}
+
+// openRealms loads the default realm from the working directory and any
+// further realms from realms.json, each stored under realms/<name>.
+func openRealms() {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = "./"
+	}
+	if err := defaultRealm.load(dir); err != nil {
+		realmLogger.Errorf("realm %s:%s", defaultRealmName, err.Error())
+	}
+	reloadRealms(false)
+}
+
+// reloadRealms applies realms.json: the users, hosts and password policy
+// of existing realms are replaced, new realms are opened and realms no
+// longer listed are dropped. An entry named "default" replaces the users
+// of the default realm. With audited set, users added, changed or removed
+// are recorded in the audit log; the first load changes nothing.
+func reloadRealms(audited bool) {
+	dir, err := os.Getwd()
+	if err != nil {
+		dir = "./"
+	}
+	var configs []realmConfig
+	buf, err := ioutil.ReadFile(filepath.Join(dir, realmsFile))
+	if err == nil {
+		err = json.Unmarshal(buf, &configs)
+	} else if os.IsNotExist(err) {
+		buf, err = nil, nil
+	}
+	realmsMu.Lock()
+	realmsErr = err
+	realmsMu.Unlock()
+	if err != nil {
+		realmLogger.Errorf("realms:%s", err.Error())
+		return
+	}
+	if buf == nil {
+		return
+	}
+	listed := make(map[string]bool)
+	for _, c := range configs {
+		if c.Name == "" || strings.ContainsAny(c.Name, `/\.`) || listed[c.Name] {
+			realmLogger.Errorf("realm %q: invalid or duplicate name", c.Name)
+			continue
+		}
+		listed[c.Name] = true
+		realmsMu.RLock()
+		r, exists := realms[c.Name]
+		realmsMu.RUnlock()
+		if !exists {
+			cookieName := c.CookieName
+			if cookieName == "" {
+				cookieName = strings.ToUpper(c.Name) + "_" + sessionName
+			}
+			r = newRealm(c.Name, cookieName, nil)
+			if err := r.load(filepath.Join(dir, realmsDir, r.name)); err != nil {
+				realmLogger.Errorf("realm %s:%s", c.Name, err.Error())
+				continue
+			}
+		}
+		users := c.users()
+		realmsMu.Lock()
+		before := r.users
+		if c.Name != defaultRealmName || len(c.Users) > 0 {
+			r.users = users
+		}
+		after := r.users
+		r.hosts = c.Hosts
+		r.clientCerts = certMappings(c.ClientCerts)
+		r.policy = c.Policy
+		realms[r.name] = r
+		realmsMu.Unlock()
+		if audited {
+			auditUserChanges(r, before, after)
+		}
+	}
+	var removed []*realm
+	realmsMu.Lock()
+	for name, r := range realms {
+		if !listed[name] && name != defaultRealmName {
+			realmLogger.Warningf("realm %s removed", name)
+			delete(realms, name)
+			removed = append(removed, r)
+		}
+	}
+	realmsMu.Unlock()
+	if audited {
+		for _, r := range removed {
+			auditUserChanges(r, r.users, nil)
+		}
+	}
+}
+
+// auditUserChanges records the users a reload added to, changed in or
+// removed from r. Removed users are logged out and lose their remember-me
+// logins; changed users keep only the scopes their new roles allow.
+func auditUserChanges(r *realm, before, after map[string]*user) {
+	var names []string
+	for name := range before {
+		names = append(names, name)
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		old, existed := before[name]
+		u, exists := after[name]
+		switch {
+		case !existed:
+			audit.recordSystem(r.name, auditUserCreate, name, outcomeSuccess)
+		case !exists:
+			audit.recordSystem(r.name, auditUserDelete, name, outcomeSuccess)
+			r.reauthorizeSessions(name, true)
+			for _, id := range r.remembered.revokeUser(name) {
+				audit.recordSystem(r.name, auditSessionRevoke, id, outcomeSuccess)
+			}
+		case !old.same(u):
+			audit.recordSystem(r.name, auditUserUpdate, name, outcomeSuccess)
+			r.reauthorizeSessions(name, false)
+			r.rescopeRemembered(name)
+		}
+	}
+}
+
+// users returns the users of c that satisfy its password policy.
+func (c realmConfig) users() map[string]*user {
+	users := make(map[string]*user)
+	for _, u := range c.Users {
+		if err := c.Policy.check(u.Password); err != nil {
+			realmLogger.Errorf("realm %s: user %s skipped: %s", c.Name, u.Username, err.Error())
+			continue
+		}
+		users[u.Username] = &user{
+			username:   u.Username,
+			password:   u.Password,
+			roles:      u.Roles,
+			totpSecret: u.TotpSecret,
+		}
+	}
+	return users
+}
+
+// resolveRealm picks the realm for req, from a /realms/{realm} path
+// prefix, optionally after the API version, which is stripped, or else
+// from the Host header. It returns nil for an unknown realm in the path.
+func resolveRealm(req *http.Request) *http.Request {
+	version := ""
+	path := req.URL.Path
+	if v, rest, ok := pathVersion(path); ok {
+		version, path = "/v"+v.name, rest
+	}
+	if strings.HasPrefix(path, "/realms/") {
+		rest := strings.TrimPrefix(path, "/realms/")
+		name := rest
+		if i := strings.Index(rest, "/"); i >= 0 {
+			name, rest = rest[:i], rest[i:]
+		} else {
+			rest = "/"
+		}
+		realmsMu.RLock()
+		r, ok := realms[name]
+		realmsMu.RUnlock()
+		if !ok {
+			return nil
+		}
+		url := *req.URL
+		url.Path = version + rest
+		req = req.WithContext(context.WithValue(req.Context(), realmKey, r))
+		req.URL = &url
+		return req
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	realmsMu.RLock()
+	defer realmsMu.RUnlock()
+	for _, r := range realms {
+		for _, h := range r.hosts {
+			if strings.EqualFold(h, host) {
+				return req.WithContext(context.WithValue(req.Context(), realmKey, r))
+			}
+		}
+	}
+	return req
+}
+
+// realmOf returns the realm selected for req.
+func realmOf(req *http.Request) *realm {
+	if r, ok := req.Context().Value(realmKey).(*realm); ok {
+		return r
+	}
+	return defaultRealm
+}
+
+// sign appends the realm's MAC to a session ID so that the cookie is only
+// accepted by the realm that issued it.
+func (r *realm) sign(sid string) string {
+	mac := hmac.New(sha256.New, r.signingKey)
+	mac.Write([]byte(sid))
+	return sid + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the session ID of a signed cookie value.
+func (r *realm) verify(value string) (string, bool) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return "", false
+	}
+	sid := value[:i]
+	if !hmac.Equal([]byte(r.sign(sid)), []byte(value)) {
+		return "", false
+	}
+	return sid, true
+}
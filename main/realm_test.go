@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// writeRealms writes realms.json with the realm name and its users, given
+// as username and role pairs, all with password.
+func writeRealms(t *testing.T, name, password string, userRoles ...string) {
+	t.Helper()
+	type realmUser struct {
+		Username string   `json:"username"`
+		Password string   `json:"password"`
+		Roles    []string `json:"roles"`
+	}
+	var list []realmUser
+	for i := 0; i < len(userRoles); i += 2 {
+		list = append(list, realmUser{userRoles[i], password, []string{userRoles[i+1]}})
+	}
+	buf, err := json.Marshal([]map[string]interface{}{{"name": name, "users": list}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(realmsFile, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// getWithToken sends a GET with token as the bearer token and decodes the
+// response.
+func getWithToken(t *testing.T, url, token string) testRsp {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	var out testRsp
+	if err := json.NewDecoder(rsp.Body).Decode(&out); err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	return out
+}
+
+func TestTokenAfterReload(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// untracked drops the sessions known to the process, as after a
+		// restart, so that only the check on lookup applies.
+		untracked bool
+		roles     []string
+		code      string
+	}{
+		{"unchanged", false, []string{"bob", "admin"}, "200"},
+		{"demoted", false, []string{"bob", "user"}, errForbidden.Code},
+		{"deleted", false, []string{"alice", "admin"}, errLoginRequired.Code},
+		{"demoted untracked", true, []string{"bob", "user"}, errForbidden.Code},
+		{"deleted untracked", true, []string{"alice", "admin"}, errLoginRequired.Code},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			srv := newTestServer(t)
+			writeRealms(t, "acme", "secret", "bob", "admin")
+			reloadRealms(false)
+			base := srv.URL + "/v1.0/realms/acme"
+			rsp := postJSON(t, newClient(t), base+"/token", map[string]string{"username": "bob", "password": "secret"})
+			if rsp.Code != "200" {
+				t.Fatalf("login: %+v", rsp)
+			}
+			token, _ := rsp.Object["token"].(string)
+			if rsp := getWithToken(t, base+"/audit", token); rsp.Code != "200" {
+				t.Fatalf("before reload: %+v", rsp)
+			}
+
+			if test.untracked {
+				activeSessions.mu.Lock()
+				activeSessions.seen = make(map[string]trackedSession)
+				activeSessions.mu.Unlock()
+			}
+			writeRealms(t, "acme", "secret", test.roles...)
+			reloadRealms(true)
+			if rsp := getWithToken(t, base+"/audit", token); rsp.Code != test.code {
+				t.Fatalf("after reload: %+v", rsp)
+			}
+		})
+	}
+}
+
+func TestRememberedAfterReload(t *testing.T) {
+	srv := newTestServer(t)
+	remembered := cookieNamed(loginCookies(t, srv.URL, true), rememberName)
+
+	// Demote admin: the series keeps only what the new roles allow.
+	writeRealms(t, defaultRealmName, "123456", "admin", "user")
+	reloadRealms(true)
+	req, _ := http.NewRequest("GET", srv.URL+"/v1.0/audit", nil)
+	req.AddCookie(remembered[0])
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusForbidden {
+		t.Fatalf("demoted: status %d", rsp.StatusCode)
+	}
+	defaultRealm.remembered.mu.Lock()
+	for _, series := range defaultRealm.remembered.series {
+		if series.Scope != scopeVersionRead {
+			t.Errorf("series scope %q", series.Scope)
+		}
+	}
+	defaultRealm.remembered.mu.Unlock()
+}
+
+func TestRealmIsolation(t *testing.T) {
+	srv := newTestServer(t)
+	// Both realms use the same cookie name, so that only the signature
+	// tells their cookies apart.
+	user := map[string]interface{}{"username": "alice", "password": "secret", "roles": []string{"admin"}}
+	buf, err := json.Marshal([]map[string]interface{}{
+		{"name": "acme", "hosts": []string{"acme.example"}, "cookie_name": "SHARED", "users": []interface{}{user}},
+		{"name": "beta", "hosts": []string{"beta.example"}, "cookie_name": "SHARED", "users": []interface{}{user}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(realmsFile, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+	reloadRealms(false)
+
+	// Log in to acme by path and to beta by Host.
+	c := newClient(t)
+	rsp := postJSON(t, c, srv.URL+"/v1.0/realms/acme/token", map[string]string{"username": "alice", "password": "secret"})
+	acmeToken, _ := rsp.Object["token"].(string)
+	if rsp.Code != "200" {
+		t.Fatalf("acme login: %+v", rsp)
+	}
+	acmeCookie := cookieNamed(c.Jar.Cookies(mustParseURL(t, srv.URL)), "SHARED")
+	req, _ := http.NewRequest("POST", srv.URL+"/v1.0/token", strings.NewReader(`{"username":"alice","password":"secret"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Host = "beta.example"
+	hrsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(hrsp.Body).Decode(&rsp)
+	hrsp.Body.Close()
+	betaToken, _ := rsp.Object["token"].(string)
+	if rsp.Code != "200" {
+		t.Fatalf("beta login: %+v", rsp)
+	}
+
+	for _, test := range []struct {
+		name, host, path string
+		token            string
+		cookies          []*http.Cookie
+		status           int
+		code             string
+	}{
+		{"acme token on acme", "", "/v1.0/realms/acme/audit", acmeToken, nil, http.StatusOK, "200"},
+		{"acme token on beta", "", "/v1.0/realms/beta/audit", acmeToken, nil, http.StatusUnauthorized, errLoginRequired.Code},
+		{"acme cookie on beta", "", "/v1.0/realms/beta/audit", "", acmeCookie, http.StatusUnauthorized, errLoginRequired.Code},
+		{"acme token on default", "", "/v1.0/audit", acmeToken, nil, http.StatusUnauthorized, errLoginRequired.Code},
+		{"acme token by host", "acme.example", "/v1.0/audit", acmeToken, nil, http.StatusOK, "200"},
+		{"acme token on beta by host", "beta.example", "/v1.0/audit", acmeToken, nil, http.StatusUnauthorized, errLoginRequired.Code},
+		{"beta token on beta", "", "/v1.0/realms/beta/audit", betaToken, nil, http.StatusOK, "200"},
+		{"path wins over host", "beta.example", "/v1.0/realms/acme/audit", acmeToken, nil, http.StatusOK, "200"},
+		{"unknown realm", "", "/v1.0/realms/nope/audit", acmeToken, nil, http.StatusNotFound, ""},
+	} {
+		req, _ := http.NewRequest("GET", srv.URL+test.path, nil)
+		if test.host != "" {
+			req.Host = test.host
+		}
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		for _, c := range test.cookies {
+			req.AddCookie(c)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out testRsp
+		json.NewDecoder(rsp.Body).Decode(&out)
+		rsp.Body.Close()
+		if rsp.StatusCode != test.status || out.Code != test.code {
+			t.Errorf("%s: status %d, %+v", test.name, rsp.StatusCode, out)
+		}
+	}
+}
+
+func mustParseURL(t *testing.T, s string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/liuzhiyi/daemon/config"
+)
+
+var reloadLogger = logger.With("component", "reload")
+
+// live holds the configuration currently in effect. cfg keeps the one
+// the daemon started with, which settings that need a restart are read
+// from.
+var live atomic.Value
+
+// liveSettings are the daemon settings applied by reload.
+var liveSettings = map[string]bool{
+	"daemon.log-level":           true,
+	"daemon.log-format":          true,
+	"daemon.access-log-format":   true,
+	"daemon.restart-mode":        true,
+	"daemon.drain-timeout":       true,
+	"daemon.captcha-after":       true,
+	"daemon.max-body":            true,
+	"daemon.watch-interval":      true,
+	"daemon.tls-cert":            true,
+	"daemon.tls-key":             true,
+	"daemon.tls-ca-cert":         true,
+	"daemon.tls-ca-key":          true,
+	"daemon.tls-hosts":           true,
+	"daemon.tls-renew-before":    true,
+	"daemon.metrics-token":       true,
+	"daemon.newdevice-2fa":       true,
+	"daemon.cors-origins":        true,
+	"daemon.login-url":           true,
+	"daemon.deprecated-versions": true,
+	"daemon.rp-id":               true,
+	"daemon.rp-origin":           true,
+	"daemon.audit-max-backups":   true,
+}
+
+func liveConfig() *config.Config {
+	if c, ok := live.Load().(*config.Config); ok {
+		return c
+	}
+	return cfg
+}
+
+// reload re-reads the configuration, realms.json and the TLS certificate
+// and applies what can change while running. An invalid configuration is
+// logged and the running one kept.
+func reload() {
+	next, err := configLoader.Load()
+	if err != nil {
+		reloadLogger.Errorf("reload:%s", err.Error())
+		return
+	}
+	var applied, restart []string
+	for _, name := range liveConfig().Changed(next, "daemon") {
+		if liveSettings[name] {
+			applied = append(applied, name)
+		} else {
+			restart = append(restart, name)
+		}
+	}
+	live.Store(next)
+	applyLogSettings(next)
+	if cfg.Daemon.TLS {
+		if err := certs.load(next.Daemon); err != nil {
+			reloadLogger.Errorf("reload:%s", err.Error())
+		}
+	}
+	reloadRealms(true)
+	reloadLogger.Infof("configuration reloaded, applied: %s", orNone(applied))
+	if len(restart) > 0 {
+		reloadLogger.Warningf("configuration reloaded, restart needed for: %s", strings.Join(restart, ", "))
+	}
+}
+
+func orNone(names []string) string {
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// watchReload reloads on SIGHUP and whenever the config file, realms.json
+// or the TLS certificate files change.
+func watchReload(exit chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	seen := modTimes()
+	for {
+		select {
+		case <-exit:
+			return
+		case <-hup:
+			reloadLogger.Info("SIGHUP received, reloading")
+			reload()
+			seen = modTimes()
+		case <-time.After(time.Duration(liveConfig().Daemon.WatchInterval)):
+			now := modTimes()
+			if changed := changedFiles(seen, now); len(changed) > 0 {
+				reloadLogger.Infof("%s changed, reloading", strings.Join(changed, ", "))
+				reload()
+				now = modTimes()
+			}
+			seen = now
+		}
+	}
+}
+
+func watchedFiles() []string {
+	c := liveConfig()
+	files := []string{realmsFile}
+	if dir, err := os.Getwd(); err == nil {
+		files[0] = filepath.Join(dir, realmsFile)
+	}
+	if c.File != "" {
+		files = append(files, c.File)
+	}
+	if cfg.Daemon.TLS {
+		files = append(files, c.Daemon.TLSCert, c.Daemon.TLSKey)
+	}
+	return files
+}
+
+func modTimes() map[string]time.Time {
+	times := make(map[string]time.Time)
+	for _, f := range watchedFiles() {
+		if fi, err := os.Stat(f); err == nil {
+			times[f] = fi.ModTime()
+		} else {
+			times[f] = time.Time{}
+		}
+	}
+	return times
+}
+
+func changedFiles(before, after map[string]time.Time) []string {
+	var changed []string
+	for f, t := range after {
+		if prev, ok := before[f]; ok && !prev.Equal(t) {
+			changed = append(changed, f)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// applyLogSettings sets the daemon's log level and format. Both are
+// validated with the rest of the configuration.
+func applyLogSettings(c *config.Config) {
+	logger.SetLevel(c.Daemon.LogLevel)
+	logger.SetFormat(c.Daemon.LogFormat)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var rememberLogger = logger.With("component", "remember")
+
+const (
+	rememberName                     = "REMEMBERME"
+	rememberPath                     = "/remember.json"
+	rememberExpiration time.Duration = 30 * 24 * time.Hour
+
+	auditRemember      = "session.remember"
+	auditRememberTheft = "session.remember.theft"
+)
+
+// rememberSeries is one remember-me login. The series ID stays fixed for
+// the life of the login while the token is replaced on every use; only
+// the token's hash is kept.
+type rememberSeries struct {
+	Username  string    `json:"username"`
+	Scope     string    `json:"scope"`
+	TokenHash string    `json:"token_hash"`
+	Expires   time.Time `json:"expires"`
+}
+
+type rememberStore struct {
+	mu     sync.Mutex
+	path   string
+	series map[string]*rememberSeries
+}
+
+func newRememberStore() *rememberStore {
+	return &rememberStore{series: make(map[string]*rememberSeries)}
+}
+
+// load reads the series kept in dir and saves there from now on.
+func (r *rememberStore) load(dir string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.path = filepath.Join(dir, rememberPath)
+	buf, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			rememberLogger.Errorf("remember me:%s", err.Error())
+		}
+		return
+	}
+	if err := json.Unmarshal(buf, &r.series); err != nil {
+		rememberLogger.Errorf("remember me:%s", err.Error())
+	}
+}
+
+// close stops saving the series.
+func (r *rememberStore) close() {
+	r.mu.Lock()
+	r.path = ""
+	r.mu.Unlock()
+}
+
+func (r *rememberStore) save() {
+	if r.path == "" {
+		return
+	}
+	now := time.Now()
+	for id, series := range r.series {
+		if now.After(series.Expires) {
+			delete(r.series, id)
+		}
+	}
+	buf, err := json.Marshal(r.series)
+	if err != nil {
+		rememberLogger.Error(err.Error())
+		return
+	}
+	tmp := r.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		rememberLogger.Errorf("remember me:%s", err.Error())
+		return
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		rememberLogger.Errorf("remember me:%s", err.Error())
+	}
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err.Error())
+	}
+	return hex.EncodeToString(buf)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func setRememberCookie(w http.ResponseWriter, r *realm, series, token string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     r.rememberName,
+		Value:    series + ":" + token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   cfg.Daemon.TLS,
+	})
+}
+
+// remember starts a remember-me series for the logged in session.
+func remember(w http.ResponseWriter, session *Session) {
+	series, token := randomHex(16), randomHex(32)
+	expires := time.Now().Add(rememberExpiration)
+	remembered := session.realm.remembered
+	remembered.mu.Lock()
+	remembered.series[series] = &rememberSeries{
+		Username:  session.container["username"],
+		Scope:     session.container["scope"],
+		TokenHash: hashToken(token),
+		Expires:   expires,
+	}
+	remembered.save()
+	remembered.mu.Unlock()
+	setRememberCookie(w, session.realm, series, token, expires)
+}
+
+// dropUser removes every series of username and returns their IDs. The
+// caller holds r.mu and saves.
+func (r *rememberStore) dropUser(username string) []string {
+	var dropped []string
+	for id, s := range r.series {
+		if s.Username == username {
+			delete(r.series, id)
+			dropped = append(dropped, id)
+		}
+	}
+	sort.Strings(dropped)
+	return dropped
+}
+
+// revokeUser ends every remember-me login of username, for a user that
+// no longer exists, and returns the IDs of the series.
+func (r *rememberStore) revokeUser(username string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dropped := r.dropUser(username)
+	if len(dropped) > 0 {
+		r.save()
+	}
+	return dropped
+}
+
+// rescopeRemembered cuts the scope of every series of username in r to
+// what the user's current roles allow.
+func (r *realm) rescopeRemembered(username string) {
+	remembered := r.remembered
+	remembered.mu.Lock()
+	defer remembered.mu.Unlock()
+	changed := false
+	for _, series := range remembered.series {
+		if series.Username != username {
+			continue
+		}
+		if scope, exists := r.currentScope(username, series.Scope); exists && scope != series.Scope {
+			series.Scope = scope
+			changed = true
+		}
+	}
+	if changed {
+		remembered.save()
+	}
+}
+
+// forget ends the remember-me login whose cookie req carries, on logout.
+func forget(w http.ResponseWriter, req *http.Request, session *Session) {
+	r := session.realm
+	cookie, err := req.Cookie(r.rememberName)
+	if err != nil {
+		return
+	}
+	id := strings.SplitN(cookie.Value, ":", 2)[0]
+	setRememberCookie(w, r, "", "", time.Unix(0, 0))
+	remembered := r.remembered
+	remembered.mu.Lock()
+	series, ok := remembered.series[id]
+	ok = ok && series.Username == session.container["username"]
+	if ok {
+		delete(remembered.series, id)
+		remembered.save()
+	}
+	remembered.mu.Unlock()
+	if ok {
+		audit.record(req, series.Username, auditSessionRevoke, id, outcomeSuccess)
+	}
+}
+
+// peekRemembered returns the user and scope of the remember-me login
+// whose cookie req carries, without using up its token or acting on a
+// mismatch, for checks that must not change any state.
+func peekRemembered(req *http.Request, r *realm) (username, scope string, ok bool) {
+	cookie, err := req.Cookie(r.rememberName)
+	if err != nil {
+		return "", "", false
+	}
+	parts := strings.SplitN(cookie.Value, ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	remembered := r.remembered
+	remembered.mu.Lock()
+	defer remembered.mu.Unlock()
+	series, ok := remembered.series[parts[0]]
+	if !ok || time.Now().After(series.Expires) ||
+		subtle.ConstantTimeCompare([]byte(series.TokenHash), []byte(hashToken(parts[1]))) != 1 {
+		return "", "", false
+	}
+	scope, exists := r.currentScope(series.Username, series.Scope)
+	if !exists {
+		return "", "", false
+	}
+	return series.Username, scope, true
+}
+
+// restoreRemembered logs a new session in from the remember-me cookie.
+// The token is single use: it is replaced on success, and a token that
+// does not match its series means the cookie was stolen, so every series
+// of that user is dropped.
+func restoreRemembered(w http.ResponseWriter, req *http.Request, session *Session) {
+	r := session.realm
+	cookie, err := req.Cookie(r.rememberName)
+	if err != nil {
+		return
+	}
+	parts := strings.SplitN(cookie.Value, ":", 2)
+	if len(parts) != 2 {
+		return
+	}
+	id, token := parts[0], parts[1]
+
+	remembered := r.remembered
+	remembered.mu.Lock()
+	defer remembered.mu.Unlock()
+	series, ok := remembered.series[id]
+	if !ok || time.Now().After(series.Expires) {
+		delete(remembered.series, id)
+		setRememberCookie(w, r, "", "", time.Unix(0, 0))
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(series.TokenHash), []byte(hashToken(token))) != 1 {
+		revoked := remembered.dropUser(series.Username)
+		remembered.save()
+		setRememberCookie(w, r, "", "", time.Unix(0, 0))
+		requestLogger(req).Warningf("remember-me token reuse for %s from %s, all persistent logins revoked", series.Username, remoteIP(req))
+		audit.record(req, series.Username, auditRememberTheft, id, outcomeFailure)
+		for _, other := range revoked {
+			audit.record(req, series.Username, auditSessionRevoke, other, outcomeSuccess)
+		}
+		return
+	}
+	scope, exists := r.currentScope(series.Username, series.Scope)
+	if !exists {
+		delete(remembered.series, id)
+		remembered.save()
+		return
+	}
+	token = randomHex(32)
+	series.TokenHash = hashToken(token)
+	series.Scope = scope
+	remembered.save()
+	setRememberCookie(w, r, id, token, series.Expires)
+	session.set("username", series.Username)
+	session.set("scope", scope)
+	audit.record(req, series.Username, auditRemember, id, outcomeSuccess)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// getWithCookies sends a GET with cookies, decodes the response and
+// returns it with the cookies set by it.
+func getWithCookies(t *testing.T, url string, cookies []*http.Cookie) (testRsp, []*http.Cookie) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	var out testRsp
+	if err := json.NewDecoder(rsp.Body).Decode(&out); err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	return out, rsp.Cookies()
+}
+
+func TestRememberedTheft(t *testing.T) {
+	srv := newTestServer(t)
+	url := srv.URL + "/v1.0/audit"
+	stolen := cookieNamed(loginCookies(t, srv.URL, true), rememberName)
+	other := cookieNamed(loginCookies(t, srv.URL, true), rememberName)
+
+	// The owner uses the token first, which rotates it.
+	rsp, cookies := getWithCookies(t, url, stolen)
+	rotated := cookieNamed(cookies, rememberName)
+	if rsp.Code != "200" || rotated == nil {
+		t.Fatalf("first use: %+v, cookies %v", rsp, cookies)
+	}
+
+	// The thief replays the old token: refused, and the cookie cleared.
+	rsp, cookies = getWithCookies(t, url, stolen)
+	if rsp.Code != errLoginRequired.Code {
+		t.Fatalf("reused: %+v", rsp)
+	}
+	if cleared := cookieNamed(cookies, rememberName); cleared == nil || cleared[0].Expires.After(time.Unix(0, 0)) {
+		t.Fatalf("reused: cookies %v", cookies)
+	}
+	records, err := audit.query(auditFilter{action: auditRememberTheft})
+	if err != nil || len(records) != 1 || records[0].Actor != "admin" {
+		t.Fatalf("audit %+v, %v", records, err)
+	}
+
+	// Every remember-me login of the user is revoked.
+	for _, test := range []struct {
+		name    string
+		cookies []*http.Cookie
+	}{
+		{"rotated token", rotated},
+		{"other series", other},
+	} {
+		if rsp, _ := getWithCookies(t, url, test.cookies); rsp.Code != errLoginRequired.Code {
+			t.Errorf("%s: %+v", test.name, rsp)
+		}
+	}
+	defaultRealm.remembered.mu.Lock()
+	n := len(defaultRealm.remembered.series)
+	defaultRealm.remembered.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("%d series left", n)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kardianos/service"
+)
+
+func TestRouterMethods(t *testing.T) {
+	srv := newTestServer(t)
+	for _, test := range []struct {
+		method, path string
+		status       int
+		allow        string
+		body         bool
+	}{
+		{"GET", "/v1.0/versions", http.StatusOK, "", true},
+		{"HEAD", "/v1.0/versions", http.StatusOK, "", false},
+		{"POST", "/v1.0/versions", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS", true},
+		{"OPTIONS", "/v1.0/versions", http.StatusNoContent, "GET, HEAD, OPTIONS", false},
+		{"DELETE", "/v1.0/token", http.StatusMethodNotAllowed, "OPTIONS, POST", true},
+		{"OPTIONS", "/v1.0/token", http.StatusNoContent, "OPTIONS, POST", false},
+		{"GET", "/v1.0/nothing", http.StatusNotFound, "", true},
+		{"OPTIONS", "/v1.0/nothing", http.StatusNotFound, "", true},
+	} {
+		req, _ := http.NewRequest(test.method, srv.URL+test.path, nil)
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if rsp.StatusCode != test.status {
+			t.Errorf("%s %s: status %d, want %d", test.method, test.path, rsp.StatusCode, test.status)
+		}
+		if got := rsp.Header.Get("Allow"); got != test.allow {
+			t.Errorf("%s %s: Allow %q, want %q", test.method, test.path, got, test.allow)
+		}
+		if (len(body) > 0) != test.body {
+			t.Errorf("%s %s: body %q", test.method, test.path, body)
+		}
+	}
+}
+
+func TestRouterParams(t *testing.T) {
+	newTestServer(t)
+	r := newRouter()
+	echo := func(name string) httpHandler {
+		return func(s service.Service, w http.ResponseWriter, req *http.Request, session *Session) {
+			io.WriteString(w, name+":"+pathParam(req, "id")+pathParam(req, "sub"))
+		}
+	}
+	r.HandleFunc(nil, "GET", "/things/{id}", echo("thing"))
+	r.HandleFunc(nil, "GET", "/things/new", echo("new"))
+	r.HandleFunc(nil, "GET", "/things/{id}/{sub}", echo("sub"))
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	for _, test := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/v1.0/things/42", http.StatusOK, "thing:42"},
+		// The route with fewer parameters wins.
+		{"/v1.0/things/new", http.StatusOK, "new:"},
+		{"/v1.0/things/42/parts", http.StatusOK, "sub:42parts"},
+		{"/v1.0/things/42/parts/7", http.StatusNotFound, ""},
+		{"/v1.0/things", http.StatusNotFound, ""},
+	} {
+		rsp, err := http.Get(srv.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if rsp.StatusCode != test.status || (test.body != "" && string(body) != test.body) {
+			t.Errorf("%s: status %d, body %q", test.path, rsp.StatusCode, body)
+		}
+	}
+}
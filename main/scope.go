@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+)
+
+const (
+	scopeServiceRestart = "service:restart"
+	scopeUsersRead      = "users:read"
+	scopeUpdatesPublish = "updates:publish"
+	scopeVersionRead    = "version:read"
+	scopeAuditRead      = "audit:read"
+)
+
+// roleScopes lists the scopes each role may be granted.
+var roleScopes = map[string][]string{
+	"admin": {scopeServiceRestart, scopeUsersRead, scopeUpdatesPublish, scopeVersionRead, scopeAuditRead},
+	"user":  {scopeVersionRead},
+}
+
+// allowedScopes returns every scope the given roles may be granted.
+func allowedScopes(roles []string) map[string]bool {
+	allowed := make(map[string]bool)
+	for _, role := range roles {
+		for _, scope := range roleScopes[role] {
+			allowed[scope] = true
+		}
+	}
+	return allowed
+}
+
+// grantScopes limits the requested scopes to those allowed by roles.
+// An empty request grants everything the roles allow.
+func grantScopes(requested string, roles []string) []string {
+	allowed := allowedScopes(roles)
+	wanted := strings.Fields(requested)
+	if len(wanted) == 0 {
+		for _, role := range roles {
+			wanted = append(wanted, roleScopes[role]...)
+		}
+	}
+	var granted []string
+	for _, scope := range wanted {
+		if allowed[scope] {
+			granted = append(granted, scope)
+			delete(allowed, scope)
+		}
+	}
+	return granted
+}
+
+// hasScopes reports whether the session was granted all required scopes.
+func (s *Session) hasScopes(required []string) bool {
+	granted := make(map[string]bool)
+	for _, scope := range strings.Fields(s.container["scope"]) {
+		granted[scope] = true
+	}
+	for _, scope := range required {
+		if !granted[scope] {
+			return false
+		}
+	}
+	return true
+}
+
+// currentScope returns the scopes of stored that the current roles of
+// username in r still allow, and false when the user no longer exists.
+// Scopes are kept from login, so a reload that demotes a user must not
+// leave their sessions with more than the new roles grant.
+func (r *realm) currentScope(username, stored string) (string, bool) {
+	u, ok := r.findUser(username)
+	if !ok {
+		return "", false
+	}
+	allowed := allowedScopes(u.roles)
+	var kept []string
+	for _, scope := range strings.Fields(stored) {
+		if allowed[scope] {
+			kept = append(kept, scope)
+		}
+	}
+	return strings.Join(kept, " "), true
+}
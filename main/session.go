@@ -0,0 +1,239 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golibs/uuid"
+	"github.com/liuzhiyi/utils/levelcache"
+)
+
+var sessionLogger = logger.With("component", "session")
+
+var cacheEng *levelcache.Levelcache
+
+// openSessions opens the session store at the configured cache path,
+// relative to the working directory.
+func openSessions() {
+	dbPath := cfg.Daemon.CachePath
+	if !filepath.IsAbs(dbPath) {
+		dir, err := os.Getwd()
+		if err != nil {
+			dir = "./"
+		}
+		dbPath = filepath.Join(dir, dbPath)
+	}
+	cacheEng = levelcache.NewLevecache(time.Duration(cfg.Daemon.SessionTTL), time.Duration(cfg.Daemon.CacheCleanup), dbPath)
+}
+
+// closeSessions writes out and closes the session store.
+func closeSessions() {
+	if cacheEng == nil {
+		return
+	}
+	if err := cacheEng.Close(); err != nil {
+		sessionLogger.Errorf("session store:%s", err.Error())
+	}
+}
+
+type Session struct {
+	sid       string
+	realm     *realm
+	container map[string]string
+}
+
+// sessionToken returns the signed session ID sent with req, from a bearer
+// Authorization header or else from the realm's session cookie.
+func sessionToken(req *http.Request, r *realm) string {
+	if token := bearerToken(req); token != "" {
+		return token
+	}
+	if cookie, err := req.Cookie(r.cookieName); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// bearerToken returns the bearer token of the Authorization header.
+func bearerToken(req *http.Request) string {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return ""
+}
+
+// lookupSession returns the existing session of req without creating one.
+func lookupSession(req *http.Request) (*Session, bool) {
+	s := new(Session)
+	s.realm = realmOf(req)
+	s.container = make(map[string]string)
+	token := sessionToken(req, s.realm)
+	if token == "" {
+		return certSession(req)
+	}
+	sid, ok := s.realm.verify(token)
+	if !ok || !isSessionID(sid) {
+		return nil, false
+	}
+	s.sid = sid
+	if !storeGet(s) {
+		return nil, false
+	}
+	s.reauthorize()
+	return s, true
+}
+
+// reauthorize holds a logged in session to the realm's current users: it
+// is logged out when its user was removed and keeps only the scopes the
+// user's current roles allow. Only the session in memory is changed, so
+// that read-only requests store nothing; it reports whether it was.
+func (s *Session) reauthorize() bool {
+	username := s.container["username"]
+	if username == "" {
+		return false
+	}
+	scope, exists := s.realm.currentScope(username, s.container["scope"])
+	switch {
+	case !exists:
+		delete(s.container, "username")
+		delete(s.container, "scope")
+	case scope != s.container["scope"]:
+		s.container["scope"] = scope
+	default:
+		return false
+	}
+	return true
+}
+
+// reauthorizeSessions applies a reload's change of username in r to the
+// sessions logged in as them: with removed set they are logged out, else
+// cut to the scopes the user's current roles allow.
+func (r *realm) reauthorizeSessions(username string, removed bool) {
+	for _, sid := range activeSessions.ofUser(r, username) {
+		s := &Session{sid: sid, realm: r, container: make(map[string]string)}
+		if !cacheEng.Get(sid, &s.container) {
+			activeSessions.forget(sid)
+			continue
+		}
+		switch {
+		case removed:
+			s.logout()
+		case s.reauthorize():
+			storeSet(s)
+		}
+	}
+}
+
+// logout ends the login of the session, keeping the session itself.
+func (s *Session) logout() {
+	delete(s.container, "username")
+	delete(s.container, "scope")
+	storeSet(s)
+	activeSessions.forget(s.sid)
+}
+
+// peekSession returns the session of req, or one logged in from its
+// remember-me cookie, without creating, storing or rotating anything.
+// Without either the session returned is empty and never stored.
+func peekSession(req *http.Request) *Session {
+	if s, ok := lookupSession(req); ok && s.container["username"] != "" {
+		return s
+	}
+	s := new(Session)
+	s.realm = realmOf(req)
+	s.container = make(map[string]string)
+	if username, scope, ok := peekRemembered(req, s.realm); ok {
+		s.container["username"] = username
+		s.container["scope"] = scope
+	}
+	return s
+}
+
+// resumeSession returns the logged in session of req, logging one in
+// from the remember-me cookie when there is none. Unlike sessionStart it
+// creates no session for a request carrying neither.
+func resumeSession(w http.ResponseWriter, req *http.Request) (*Session, bool) {
+	s, ok := lookupSession(req)
+	if ok && s.container["username"] != "" {
+		return s, true
+	}
+	if _, err := req.Cookie(realmOf(req).rememberName); err != nil {
+		return nil, false
+	}
+	if !ok {
+		s = newSession(w, req)
+	}
+	restoreRemembered(w, req, s)
+	return s, s.container["username"] != ""
+}
+
+func sessionStart(w http.ResponseWriter, req *http.Request) *Session {
+	if s, ok := lookupSession(req); ok {
+		return s
+	}
+	s := newSession(w, req)
+	restoreRemembered(w, req, s)
+	return s
+}
+
+// newSession stores an empty session and sets its cookie.
+func newSession(w http.ResponseWriter, req *http.Request) *Session {
+	s := new(Session)
+	s.realm = realmOf(req)
+	s.container = make(map[string]string)
+	cookie := new(http.Cookie)
+	cookie.Path = "/"
+	sid := strings.Replace(uuid.Rand().Hex(), "-", "", -1)
+	cookie.Name = s.realm.cookieName
+	cookie.Value = s.realm.sign(sid)
+	http.SetCookie(w, cookie)
+	s.sid = sid
+	storeSet(s)
+	return s
+}
+
+// isSessionID reports whether sid is hex, as newSession makes them, so
+// that other entries of the session store are never looked up as one.
+func isSessionID(sid string) bool {
+	if sid == "" {
+		return false
+	}
+	for _, c := range sid {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// token returns the signed session ID, usable as a bearer token.
+func (s *Session) token() string {
+	return s.realm.sign(s.sid)
+}
+
+func (s *Session) set(key, val string) {
+	s.container[key] = val
+	storeSet(s)
+}
+
+// storeGet reads the session s.sid from the store, counting the
+// operation.
+func storeGet(s *Session) bool {
+	if !cacheEng.Get(s.sid, &s.container) {
+		sessionOps.inc("get", "miss")
+		return false
+	}
+	sessionOps.inc("get", "hit")
+	activeSessions.touch(s)
+	return true
+}
+
+// storeSet writes a session to the store, counting the operation.
+func storeSet(s *Session) {
+	cacheEng.Set(s.sid, s.container, 0)
+	sessionOps.inc("set", "ok")
+	activeSessions.touch(s)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kardianos/service"
+	"github.com/liuzhiyi/daemon/config"
+)
+
+var tlsLogger = logger.With("component", "tls")
+
+const (
+	caValidity = 10 * 365 * 24 * time.Hour
+
+	// renewCheck is the longest wait between renewal checks, so that a
+	// changed tls-renew-before is noticed; renewRetry the wait after a
+	// certificate could not be renewed.
+	renewCheck = time.Hour
+	renewRetry = time.Minute
+)
+
+// tlsManager serves the daemon's certificate through GetCertificate, so
+// that a new one is picked up without restarting the listener. When no
+// certificate is configured it issues one from a local CA, creating the
+// CA on first use, and renews the certificates it issued before they
+// expire.
+type tlsManager struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+var certs = &tlsManager{}
+
+// load loads the configured certificate, issuing it when missing or
+// when an issued one is due for renewal.
+func (m *tlsManager) load(c config.Daemon) error {
+	cert, err := loadCert(c.TLSCert, c.TLSKey)
+	switch {
+	case os.IsNotExist(err):
+		tlsLogger.Infof("no certificate at %s, issuing one for %s", c.TLSCert, c.TLSHosts)
+		cert, err = issueCert(c)
+	case err == nil && renewDue(cert, c):
+		if !issuedByCA(cert, c) {
+			tlsLogger.Warningf("certificate %s expires %s, replace it", c.TLSCert, cert.Leaf.NotAfter.Format(time.RFC3339))
+			break
+		}
+		tlsLogger.Infof("certificate %s expires %s, renewing", c.TLSCert, cert.Leaf.NotAfter.Format(time.RFC3339))
+		cert, err = issueCert(c)
+	}
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.cert = cert
+	m.mu.Unlock()
+	return nil
+}
+
+// renew reloads the certificate once it is due for renewal.
+func (m *tlsManager) renew() {
+	c := liveConfig().Daemon
+	m.mu.RLock()
+	due := m.cert != nil && renewDue(m.cert, c)
+	m.mu.RUnlock()
+	if !due {
+		return
+	}
+	if err := m.load(c); err != nil {
+		tlsLogger.Errorf("renew certificate:%s", err.Error())
+	}
+}
+
+// untilRenewal returns how long to wait before checking the certificate
+// again.
+func (m *tlsManager) untilRenewal() time.Duration {
+	c := liveConfig().Daemon
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil {
+		return renewCheck
+	}
+	d := time.Until(m.cert.Leaf.NotAfter) - time.Duration(c.TLSRenewBefore)
+	switch {
+	case d <= 0:
+		return renewRetry
+	case d > renewCheck:
+		return renewCheck
+	}
+	return d
+}
+
+// watchRenewal renews the certificate when it is due, until exit is
+// closed.
+func (m *tlsManager) watchRenewal(exit chan struct{}) {
+	timer := time.NewTimer(m.untilRenewal())
+	defer timer.Stop()
+	for {
+		select {
+		case <-exit:
+			return
+		case <-timer.C:
+			m.renew()
+			timer.Reset(m.untilRenewal())
+		}
+	}
+}
+
+func (m *tlsManager) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cert, nil
+}
+
+// loadCert loads a key pair with its parsed leaf certificate.
+func loadCert(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func renewDue(cert *tls.Certificate, c config.Daemon) bool {
+	return time.Until(cert.Leaf.NotAfter) < time.Duration(c.TLSRenewBefore)
+}
+
+// issuedByCA reports whether cert was signed by the local CA, which
+// means the daemon may replace it.
+func issuedByCA(cert *tls.Certificate, c config.Daemon) bool {
+	ca, err := loadCert(c.TLSCACert, c.TLSCAKey)
+	return err == nil && cert.Leaf.CheckSignatureFrom(ca.Leaf) == nil
+}
+
+// ensureCA loads the local CA, creating it when missing.
+func ensureCA(c config.Daemon) (*tls.Certificate, error) {
+	ca, err := loadCert(c.TLSCACert, c.TLSCAKey)
+	if !os.IsNotExist(err) {
+		return ca, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: cfg.Daemon.ServiceName + " local CA"},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if err := createCert(tmpl, nil, key, caValidity, c.TLSCACert, c.TLSCAKey); err != nil {
+		return nil, err
+	}
+	return loadCert(c.TLSCACert, c.TLSCAKey)
+}
+
+// issueCert issues a server certificate for the configured hosts from
+// the local CA and writes it to the configured files.
+func issueCert(c config.Daemon) (*tls.Certificate, error) {
+	ca, err := ensureCA(c)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: strings.Split(c.TLSHosts, ",")[0]},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range strings.Split(c.TLSHosts, ",") {
+		host = strings.TrimSpace(host)
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if host != "" {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	if err := createCert(tmpl, ca, key, config.IssuedCertValidity, c.TLSCert, c.TLSKey); err != nil {
+		return nil, err
+	}
+	return loadCert(c.TLSCert, c.TLSKey)
+}
+
+// createCert signs tmpl with parent, or self-signs it when parent is nil,
+// and writes the certificate and key as PEM. The key file is only
+// readable by the daemon's user.
+func createCert(tmpl *x509.Certificate, parent *tls.Certificate, key *ecdsa.PrivateKey, validity time.Duration, certFile, keyFile string) error {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(validity)
+	issuer, signer := tmpl, interface{}(key)
+	if parent != nil {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, &key.PublicKey, signer)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// exportCA writes the local CA certificate, creating the CA when
+// missing, for clients to trust, and prints its fingerprint. It backs
+// the "tls export-ca" command.
+func exportCA(path string) error {
+	ca, err := ensureCA(cfg.Daemon)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "SHA-256 fingerprint: %X\n", sha256.Sum256(ca.Certificate[0]))
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]})
+	if path == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// CACert serves the local CA certificate so that clients can fetch it on
+// first contact. Compare its fingerprint with the one from "tls
+// export-ca" before trusting it.
+func CACert(s service.Service, w http.ResponseWriter, req *http.Request, session *Session) {
+	buf, err := ioutil.ReadFile(liveConfig().Daemon.TLSCACert)
+	if err != nil {
+		requestLogger(req).Errorf("ca:%s", err.Error())
+		writeError(w, req, errSystem, nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(buf)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/liuzhiyi/daemon/config"
+)
+
+func TestCertificateRenewal(t *testing.T) {
+	logger.SetOutput(ioutil.Discard)
+	dir := t.TempDir()
+	c := config.Default()
+	c.Daemon.TLSCert = filepath.Join(dir, "cert.pem")
+	c.Daemon.TLSKey = filepath.Join(dir, "key.pem")
+	c.Daemon.TLSCACert = filepath.Join(dir, "ca.pem")
+	c.Daemon.TLSCAKey = filepath.Join(dir, "ca-key.pem")
+	c.Daemon.TLSRenewBefore = config.Duration(2 * time.Second)
+	defer live.Store(liveConfig())
+	live.Store(c)
+
+	// A certificate from the local CA that is due for renewal in a second.
+	ca, err := ensureCA(c.Daemon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if err := createCert(tmpl, ca, key, 3*time.Second, c.Daemon.TLSCert, c.Daemon.TLSKey); err != nil {
+		t.Fatal(err)
+	}
+	m := &tlsManager{}
+	if err := m.load(c.Daemon); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := m.getCertificate(nil)
+
+	exit := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		m.watchRenewal(exit)
+		close(stopped)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cert, _ := m.getCertificate(nil)
+		if cert != first {
+			if time.Until(cert.Leaf.NotAfter) < config.IssuedCertValidity-time.Hour {
+				t.Fatalf("renewed certificate expires %s", cert.Leaf.NotAfter)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("certificate not renewed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	onDisk, err := loadCert(c.Daemon.TLSCert, c.Daemon.TLSKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, _ := m.getCertificate(nil); !onDisk.Leaf.Equal(cert.Leaf) {
+		t.Error("renewed certificate not written")
+	}
+
+	close(exit)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("renewal timer not stopped")
+	}
+}
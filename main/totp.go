@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+)
+
+// totpStep returns the RFC 6238 time step of t.
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// totpCode computes the RFC 6238 code for secret at time step step.
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000), nil
+}
+
+// totpSteps remembers the last time step a code was accepted for, per
+// user, so that a code is used once only.
+type totpSteps struct {
+	mu   sync.Mutex
+	last map[string]int64
+}
+
+func newTOTPSteps() *totpSteps {
+	return &totpSteps{last: make(map[string]int64)}
+}
+
+// check accepts the code of u for the current period or either neighbour,
+// unless a code of that period or a later one was accepted before.
+func (s *totpSteps) check(u *user, code string) bool {
+	return s.checkAt(u, code, time.Now())
+}
+
+func (s *totpSteps) checkAt(u *user, code string, t time.Time) bool {
+	now := totpStep(t)
+	for _, step := range []int64{now, now - 1, now + 1} {
+		want, err := totpCode(u.totpSecret, step)
+		if err != nil {
+			return false
+		}
+		if subtle.ConstantTimeCompare([]byte(want), []byte(code)) != 1 {
+			continue
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if last, ok := s.last[u.username]; ok && step <= last {
+			return false
+		}
+		s.last[u.username] = step
+		return true
+	}
+	return false
+}
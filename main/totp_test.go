@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTOTPReplay(t *testing.T) {
+	steps := newTOTPSteps()
+	alice := &user{username: "alice", totpSecret: "JBSWY3DPEHPK3PXP"}
+	bob := &user{username: "bob", totpSecret: "JBSWY3DPEHPK3PXP"}
+	now := time.Now()
+	code := func(skew int64) string {
+		c, err := totpCode(alice.totpSecret, totpStep(now)+skew)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	for _, test := range []struct {
+		name string
+		u    *user
+		skew int64
+		ok   bool
+	}{
+		{"previous period", alice, -1, true},
+		{"current period", alice, 0, true},
+		{"replayed", alice, 0, false},
+		{"earlier period", alice, -1, false},
+		{"other user", bob, 0, true},
+		{"next period", alice, 1, true},
+		{"after the next period", alice, 0, false},
+		{"outside the window", bob, 2, false},
+	} {
+		if got := steps.checkAt(test.u, code(test.skew), now); got != test.ok {
+			t.Errorf("%s: accepted %v, want %v", test.name, got, test.ok)
+		}
+	}
+}
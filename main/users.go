@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+)
+
+type user struct {
+	username   string
+	password   string
+	roles      []string
+	totpSecret string
+}
+
+// users is the built-in user table of the default realm.
+var users = map[string]*user{
+	"admin": {username: "admin", password: "123456", roles: []string{"admin"}},
+}
+
+// same reports whether u and other have the same password, roles and
+// one-time password secret.
+func (u *user) same(other *user) bool {
+	return u.password == other.password &&
+		u.totpSecret == other.totpSecret &&
+		strings.Join(u.roles, ",") == strings.Join(other.roles, ",")
+}
+
+func (r *realm) findUser(username string) (*user, bool) {
+	realmsMu.RLock()
+	defer realmsMu.RUnlock()
+	u, ok := r.users[username]
+	return u, ok
+}
+
+func (r *realm) checkPassword(username, password string) (*user, bool) {
+	u, ok := r.findUser(username)
+	if !ok || u.password != password {
+		return nil, false
+	}
+	return u, true
+}
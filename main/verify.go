@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/kardianos/service"
+)
+
+// originalURL reconstructs the URL the proxy is authorizing, from the
+// headers set by nginx auth_request or Traefik/Caddy forward auth.
+func originalURL(req *http.Request) string {
+	if u := req.Header.Get("X-Original-URL"); u != "" {
+		return u
+	}
+	host := req.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		return ""
+	}
+	proto := req.Header.Get("X-Forwarded-Proto")
+	if proto == "" {
+		proto = "http"
+	}
+	return proto + "://" + host + req.Header.Get("X-Forwarded-Uri")
+}
+
+// unauthorized answers 401 with a Location pointing at the login page,
+// which returns to original, or redirects there when the request asks for
+// it with ?redirect=1.
+func unauthorized(w http.ResponseWriter, req *http.Request, original string) {
+	status := http.StatusUnauthorized
+	if location := liveConfig().Daemon.LoginURL; location != "" {
+		if original != "" {
+			sep := "?"
+			if strings.Contains(location, "?") {
+				sep = "&"
+			}
+			location += sep + "rd=" + url.QueryEscape(original)
+		}
+		w.Header().Set("Location", location)
+		if req.URL.Query().Get("redirect") != "" {
+			status = http.StatusFound
+		}
+	}
+	w.WriteHeader(status)
+}
+
+// Verify answers forward-auth subrequests from reverse proxies. An
+// authenticated request gets 200 with X-Auth-User and X-Auth-Roles. Other
+// requests get 401 with a Location pointing at the login page, or a 302
+// to it when called with ?redirect=1; a session lacking ?role= gets 403.
+// It is registered read-only: a remember-me cookie is honoured but not
+// rotated, and no session or cookie is created.
+func Verify(s service.Service, w http.ResponseWriter, req *http.Request, session *Session) {
+	username, logined := session.container["username"]
+	u, exists := session.realm.findUser(username)
+	if !logined || !exists {
+		unauthorized(w, req, originalURL(req))
+		return
+	}
+	if role := req.URL.Query().Get("role"); role != "" && !hasRole(u, []string{role}) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	w.Header().Set("X-Auth-User", u.username)
+	w.Header().Set("X-Auth-Roles", strings.Join(u.roles, ","))
+	w.Header().Set("X-Auth-Realm", session.realm.name)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// verify calls /verify as a forward-auth proxy would, with the given
+// cookies and headers, without following redirects.
+func verify(t *testing.T, base, query string, cookies []*http.Cookie, header map[string]string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest("GET", base+"/v1.0/verify"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	c := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	rsp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	return rsp
+}
+
+// loginCookies logs admin in and returns the cookies a browser would hold.
+func loginCookies(t *testing.T, base string, remember bool) []*http.Cookie {
+	t.Helper()
+	c := newClient(t)
+	body := map[string]string{"username": "admin", "password": "123456"}
+	if remember {
+		body["remember"] = "true"
+	}
+	if rsp := postJSON(t, c, base+"/v1.0/token", body); rsp.Code != "200" {
+		t.Fatalf("login: %+v", rsp)
+	}
+	u, _ := url.Parse(base)
+	return c.Jar.Cookies(u)
+}
+
+func cookieNamed(cookies []*http.Cookie, name string) []*http.Cookie {
+	for _, c := range cookies {
+		if c.Name == name {
+			return []*http.Cookie{c}
+		}
+	}
+	return nil
+}
+
+func TestVerifyAllow(t *testing.T) {
+	srv := newTestServer(t)
+	rsp := verify(t, srv.URL, "", loginCookies(t, srv.URL, false), nil)
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", rsp.StatusCode)
+	}
+	if got := rsp.Header.Get("X-Auth-User"); got != "admin" {
+		t.Errorf("X-Auth-User %q", got)
+	}
+	if got := rsp.Header.Get("X-Auth-Roles"); got != "admin" {
+		t.Errorf("X-Auth-Roles %q", got)
+	}
+	if got := rsp.Header.Get("X-Auth-Realm"); got != defaultRealmName {
+		t.Errorf("X-Auth-Realm %q", got)
+	}
+	if len(rsp.Cookies()) != 0 {
+		t.Errorf("cookies set: %v", rsp.Cookies())
+	}
+
+	if rsp := verify(t, srv.URL, "?role=admin", loginCookies(t, srv.URL, false), nil); rsp.StatusCode != http.StatusOK {
+		t.Errorf("role admin: status %d", rsp.StatusCode)
+	}
+	if rsp := verify(t, srv.URL, "?role=auditor", loginCookies(t, srv.URL, false), nil); rsp.StatusCode != http.StatusForbidden {
+		t.Errorf("role auditor: status %d", rsp.StatusCode)
+	}
+}
+
+func TestVerifyDeny(t *testing.T) {
+	srv := newTestServer(t)
+	c := *liveConfig()
+	c.Daemon.LoginURL = "https://login.example/"
+	live.Store(&c)
+
+	forwarded := map[string]string{
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "app.example",
+		"X-Forwarded-Uri":   "/reports?id=7",
+	}
+	want := "https://login.example/?rd=" + url.QueryEscape("https://app.example/reports?id=7")
+
+	rsp := verify(t, srv.URL, "", nil, forwarded)
+	if rsp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("status %d", rsp.StatusCode)
+	}
+	if got := rsp.Header.Get("Location"); got != want {
+		t.Errorf("Location %q, want %q", got, want)
+	}
+	if rsp.Header.Get("X-Auth-User") != "" {
+		t.Errorf("X-Auth-User set on a denied request")
+	}
+	if len(rsp.Cookies()) != 0 {
+		t.Errorf("cookies set: %v", rsp.Cookies())
+	}
+
+	rsp = verify(t, srv.URL, "?redirect=1", nil, map[string]string{"X-Original-URL": "https://app.example/x"})
+	if rsp.StatusCode != http.StatusFound {
+		t.Fatalf("redirect: status %d", rsp.StatusCode)
+	}
+	want = "https://login.example/?rd=" + url.QueryEscape("https://app.example/x")
+	if got := rsp.Header.Get("Location"); got != want {
+		t.Errorf("redirect: Location %q, want %q", got, want)
+	}
+}
+
+func TestVerifyRememberedIsReadOnly(t *testing.T) {
+	srv := newTestServer(t)
+	remembered := cookieNamed(loginCookies(t, srv.URL, true), rememberName)
+	if remembered == nil {
+		t.Fatal("no remember-me cookie")
+	}
+	// The same remember-me token keeps working, as it is never rotated.
+	for i := 0; i < 2; i++ {
+		rsp := verify(t, srv.URL, "", remembered, nil)
+		if rsp.StatusCode != http.StatusOK || rsp.Header.Get("X-Auth-User") != "admin" {
+			t.Fatalf("call %d: status %d, user %q", i, rsp.StatusCode, rsp.Header.Get("X-Auth-User"))
+		}
+		if len(rsp.Cookies()) != 0 {
+			t.Fatalf("call %d: cookies set: %v", i, rsp.Cookies())
+		}
+	}
+
+	forged := []*http.Cookie{{Name: rememberName, Value: "0123:4567"}}
+	if rsp := verify(t, srv.URL, "", forged, nil); rsp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("forged cookie: status %d", rsp.StatusCode)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kardianos/service"
+)
+
+var versionLogger = logger.With("component", "version")
+
+// apiVersion is one API version served side by side with the others.
+type apiVersion struct {
+	name string
+}
+
+// apiVersions lists the served versions, oldest first. vesion is the
+// default for requests that do not ask for one.
+var apiVersions = []*apiVersion{
+	{name: "1.0"},
+	{name: "1.1"},
+	{name: "2"},
+}
+
+func findVersion(name string) (*apiVersion, bool) {
+	for _, v := range apiVersions {
+		if v.name == name {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// deprecation returns whether deprecated-versions marks v deprecated, and
+// the sunset date given with it, if any. Dates are checked with the rest
+// of the configuration.
+func (v *apiVersion) deprecation() (deprecated bool, sunset time.Time) {
+	for _, item := range strings.Split(liveConfig().Daemon.DeprecatedVersions, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "@", 2)
+		if parts[0] != v.name {
+			continue
+		}
+		if len(parts) == 2 {
+			sunset, _ = time.Parse("2006-01-02", parts[1])
+		}
+		return true, sunset
+	}
+	return false, time.Time{}
+}
+
+// pathVersion returns the version named by a /v{version}/ path prefix and
+// the rest of the path.
+func pathVersion(path string) (*apiVersion, string, bool) {
+	if !strings.HasPrefix(path, "/v") {
+		return nil, path, false
+	}
+	name := path[2:]
+	rest := "/"
+	if i := strings.Index(name, "/"); i >= 0 {
+		name, rest = name[:i], name[i:]
+	}
+	v, ok := findVersion(name)
+	if !ok {
+		return nil, path, false
+	}
+	return v, rest, true
+}
+
+// negotiateVersion picks the version for a path without a version prefix
+// from the Accept-Version header, falling back to vesion.
+func negotiateVersion(req *http.Request) (*apiVersion, bool) {
+	name := strings.TrimSpace(req.Header.Get("Accept-Version"))
+	if name == "" {
+		name = vesion
+	}
+	return findVersion(strings.TrimPrefix(name, "v"))
+}
+
+func versionOf(req *http.Request) *apiVersion {
+	v, _ := req.Context().Value(versionKey).(*apiVersion)
+	return v
+}
+
+// versionHeaders reports the version that served the request and warns
+// clients of deprecated versions.
+func versionHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if v := versionOf(req); v != nil {
+			h := w.Header()
+			h.Set("API-Version", v.name)
+			if deprecated, sunset := v.deprecation(); deprecated {
+				h.Set("Deprecation", "true")
+				h.Set("Link", `</v`+v.name+`/versions>; rel="deprecation"`)
+				if !sunset.IsZero() {
+					h.Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+				}
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Versions lists the API versions the daemon serves.
+func Versions(s service.Service, w http.ResponseWriter, req *http.Request, session *Session) {
+	var data Rsp
+	var versions []map[string]interface{}
+	for _, v := range apiVersions {
+		deprecated, sunset := v.deprecation()
+		item := map[string]interface{}{
+			"version":    v.name,
+			"deprecated": deprecated,
+		}
+		if !sunset.IsZero() {
+			item["sunset"] = sunset.Format("2006-01-02")
+		}
+		versions = append(versions, item)
+	}
+	data.Code = "200"
+	data.Object = map[string]interface{}{
+		"versions": versions,
+		"default":  vesion,
+		"latest":   apiVersions[len(apiVersions)-1].name,
+	}
+	output(w, data)
+}
+
+func withVersion(req *http.Request, v *apiVersion) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), versionKey, v))
+}
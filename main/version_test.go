@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestVersionNegotiation(t *testing.T) {
+	srv := newTestServer(t)
+	c := *liveConfig()
+	c.Daemon.DeprecatedVersions = "1.0@2027-01-31, 1.1"
+	live.Store(&c)
+
+	for _, test := range []struct {
+		path, acceptVersion string
+		status              int
+		version             string
+		deprecation, sunset string
+	}{
+		{"/v1.0/versions", "", http.StatusOK, "1.0", "true", "Sun, 31 Jan 2027 00:00:00 GMT"},
+		{"/v1.1/versions", "", http.StatusOK, "1.1", "true", ""},
+		{"/v2/versions", "", http.StatusOK, "2", "", ""},
+		// Unversioned paths take Accept-Version, or else the default.
+		{"/versions", "", http.StatusOK, vesion, "true", "Sun, 31 Jan 2027 00:00:00 GMT"},
+		{"/versions", "2", http.StatusOK, "2", "", ""},
+		{"/versions", "v1.1", http.StatusOK, "1.1", "true", ""},
+		{"/versions", "3", http.StatusNotAcceptable, "", "", ""},
+		// A path version wins over the header.
+		{"/v2/versions", "1.0", http.StatusOK, "2", "", ""},
+		// An unknown version is an unknown path of the default one.
+		{"/v3/versions", "", http.StatusNotFound, vesion, "true", "Sun, 31 Jan 2027 00:00:00 GMT"},
+	} {
+		req, _ := http.NewRequest("GET", srv.URL+test.path, nil)
+		if test.acceptVersion != "" {
+			req.Header.Set("Accept-Version", test.acceptVersion)
+		}
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		name := test.path + " " + test.acceptVersion
+		if rsp.StatusCode != test.status {
+			t.Errorf("%s: status %d, want %d", name, rsp.StatusCode, test.status)
+		}
+		if got := rsp.Header.Get("API-Version"); got != test.version {
+			t.Errorf("%s: API-Version %q, want %q", name, got, test.version)
+		}
+		if got := rsp.Header.Get("Deprecation"); got != test.deprecation {
+			t.Errorf("%s: Deprecation %q, want %q", name, got, test.deprecation)
+		}
+		if got := rsp.Header.Get("Sunset"); got != test.sunset {
+			t.Errorf("%s: Sunset %q, want %q", name, got, test.sunset)
+		}
+	}
+}
+
+func TestVersionsList(t *testing.T) {
+	srv := newTestServer(t)
+	c := *liveConfig()
+	c.Daemon.DeprecatedVersions = "1.0@2027-01-31"
+	live.Store(&c)
+
+	rsp := getWithToken(t, srv.URL+"/v2/versions", "")
+	if rsp.Code != "200" || rsp.Object["default"] != vesion || rsp.Object["latest"] != "2" {
+		t.Fatalf("got %+v", rsp)
+	}
+	versions, _ := rsp.Object["versions"].([]interface{})
+	if len(versions) != len(apiVersions) {
+		t.Fatalf("versions %v", versions)
+	}
+	first, _ := versions[0].(map[string]interface{})
+	if first["version"] != "1.0" || first["deprecated"] != true || first["sunset"] != "2027-01-31" {
+		t.Fatalf("first %v", first)
+	}
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/kardianos/service"
+)
+
+var webauthnLogger = logger.With("component", "webauthn")
+
+const (
+	webauthnPath    = "/webauthn.json"
+	webauthnTimeout = 60000
+
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+
+	flagUserPresent  = 0x01
+	flagAttestedData = 0x40
+
+	auditWebauthnRegister = "webauthn.register"
+)
+
+var b64url = base64.RawURLEncoding
+
+type webauthnCredential struct {
+	ID        string `json:"id"`
+	PublicKey []byte `json:"public_key"`
+	SignCount uint32 `json:"sign_count"`
+}
+
+// credentialStore holds the WebAuthn credentials registered by each user.
+type credentialStore struct {
+	mu    sync.Mutex
+	path  string
+	users map[string][]*webauthnCredential
+}
+
+func newCredentialStore() *credentialStore {
+	return &credentialStore{users: make(map[string][]*webauthnCredential)}
+}
+
+// load reads the credentials kept in dir and saves there from now on.
+func (c *credentialStore) load(dir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.path = filepath.Join(dir, webauthnPath)
+	buf, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			webauthnLogger.Errorf("webauthn credentials:%s", err.Error())
+		}
+		return
+	}
+	if err := json.Unmarshal(buf, &c.users); err != nil {
+		webauthnLogger.Errorf("webauthn credentials:%s", err.Error())
+	}
+}
+
+// close stops saving the credentials; registering one fails from then
+// on.
+func (c *credentialStore) close() {
+	c.mu.Lock()
+	c.path = ""
+	c.mu.Unlock()
+}
+
+func (c *credentialStore) save() error {
+	if c.path == "" {
+		return errStoreClosed
+	}
+	buf, err := json.Marshal(c.users)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+func (c *credentialStore) ids(username string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ids []string
+	for _, cred := range c.users[username] {
+		ids = append(ids, cred.ID)
+	}
+	return ids
+}
+
+func (c *credentialStore) add(username string, cred *webauthnCredential) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, creds := range c.users {
+		for _, existing := range creds {
+			if existing.ID == cred.ID {
+				return errors.New("webauthn: credential already registered")
+			}
+		}
+	}
+	c.users[username] = append(c.users[username], cred)
+	return c.save()
+}
+
+type webauthnChallenge struct {
+	value   string
+	expires time.Time
+}
+
+// webauthnChallenges holds the outstanding registration and assertion
+// challenges of a realm, one of each kind per session. Like the key
+// challenges they expire and are bounded, since anyone can request them.
+type webauthnChallenges struct {
+	mu         sync.Mutex
+	challenges map[string]webauthnChallenge
+}
+
+func newWebauthnChallenges() *webauthnChallenges {
+	return &webauthnChallenges{challenges: make(map[string]webauthnChallenge)}
+}
+
+// newWebauthnChallenge issues a fresh challenge of kind for the session,
+// replacing any outstanding one, and returns it.
+func newWebauthnChallenge(session *Session, kind string) string {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		panic(err.Error())
+	}
+	encoded := b64url.EncodeToString(challenge)
+	w := session.realm.webauthnChallenges
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.challenges) >= maxKeyChallenges {
+		w.sweepLocked()
+	}
+	if len(w.challenges) >= maxKeyChallenges {
+		var oldest string
+		for key, c := range w.challenges {
+			if oldest == "" || c.expires.Before(w.challenges[oldest].expires) {
+				oldest = key
+			}
+		}
+		delete(w.challenges, oldest)
+	}
+	w.challenges[kind+"\xff"+session.sid] = webauthnChallenge{value: encoded, expires: time.Now().Add(challengeExpiration)}
+	return encoded
+}
+
+// takeWebauthnChallenge returns and clears the challenge of kind issued
+// for the session, so that each challenge is used at most once. It returns
+// "" when there is none or it expired.
+func takeWebauthnChallenge(session *Session, kind string) string {
+	w := session.realm.webauthnChallenges
+	key := kind + "\xff" + session.sid
+	w.mu.Lock()
+	c, ok := w.challenges[key]
+	delete(w.challenges, key)
+	w.mu.Unlock()
+	if !ok || time.Now().After(c.expires) {
+		return ""
+	}
+	return c.value
+}
+
+// sweep drops expired challenges.
+func (w *webauthnChallenges) sweep() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.sweepLocked()
+}
+
+func (w *webauthnChallenges) sweepLocked() {
+	now := time.Now()
+	for key, c := range w.challenges {
+		if now.After(c.expires) {
+			delete(w.challenges, key)
+		}
+	}
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+func checkClientData(raw []byte, typ, challenge string) error {
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return err
+	}
+	if cd.Type != typ {
+		return errors.New("webauthn: wrong client data type")
+	}
+	if challenge == "" || subtle.ConstantTimeCompare([]byte(cd.Challenge), []byte(challenge)) != 1 {
+		return errors.New("webauthn: challenge mismatch")
+	}
+	if cd.Origin != liveConfig().Daemon.RPOrigin {
+		return errors.New("webauthn: origin mismatch")
+	}
+	return nil
+}
+
+type authenticatorData struct {
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+func parseAuthenticatorData(raw []byte) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, errors.New("webauthn: authenticator data too short")
+	}
+	rpIDHash := sha256.Sum256([]byte(liveConfig().Daemon.RPID))
+	if !bytes.Equal(raw[:32], rpIDHash[:]) {
+		return nil, errors.New("webauthn: relying party mismatch")
+	}
+	ad := &authenticatorData{
+		flags:     raw[32],
+		signCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+	if ad.flags&flagUserPresent == 0 {
+		return nil, errors.New("webauthn: user not present")
+	}
+	if ad.flags&flagAttestedData != 0 {
+		rest := raw[37:]
+		if len(rest) < 18 {
+			return nil, errors.New("webauthn: attested data too short")
+		}
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < idLen {
+			return nil, errors.New("webauthn: credential ID too short")
+		}
+		ad.credentialID = rest[:idLen]
+		_, n, err := cborDecode(rest[idLen:])
+		if err != nil {
+			return nil, err
+		}
+		ad.publicKey = rest[idLen : idLen+n]
+	}
+	return ad, nil
+}
+
+// parseCOSEKey decodes a COSE encoded ES256 or EdDSA public key.
+func parseCOSEKey(coseKey []byte) (interface{}, error) {
+	v, _, err := cborDecode(coseKey)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("webauthn: malformed public key")
+	}
+	alg, _ := key[int64(3)].(int64)
+	switch alg {
+	case coseAlgES256:
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if crv, _ := key[int64(-1)].(int64); crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("webauthn: unsupported EC key")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("webauthn: invalid EC point")
+		}
+		return pub, nil
+	case coseAlgEdDSA:
+		x, _ := key[int64(-2)].([]byte)
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("webauthn: unsupported OKP key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, errors.New("webauthn: unsupported algorithm")
+}
+
+// verifyCOSESignature checks sig over msg with a COSE encoded public key.
+func verifyCOSESignature(coseKey, msg, sig []byte) error {
+	key, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return err
+	}
+	var valid bool
+	switch pub := key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(msg)
+		valid = ecdsa.VerifyASN1(pub, digest[:], sig)
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(pub, msg, sig)
+	}
+	if !valid {
+		return errors.New("webauthn: bad signature")
+	}
+	return nil
+}
+
+func decodeParams(params ...string) ([][]byte, bool) {
+	values := make([][]byte, len(params))
+	for i, param := range params {
+		v, err := b64url.DecodeString(param)
+		if err != nil || len(v) == 0 {
+			return nil, false
+		}
+		values[i] = v
+	}
+	return values, true
+}
+
+// checkAssertion verifies a WebAuthn assertion against the challenge in
+// the session and updates the credential's sign count.
+func checkAssertion(session *Session, body *tokenRequest) (*user, bool) {
+	challenge := takeWebauthnChallenge(session, "webauthn_login")
+	username := session.container["webauthn_login_user"]
+	values, ok := decodeParams(body.ClientDataJSON, body.AuthenticatorData, body.Signature)
+	if !ok || username == "" {
+		return nil, false
+	}
+	rawClientData, rawAuthData, sig := values[0], values[1], values[2]
+	if err := checkClientData(rawClientData, "webauthn.get", challenge); err != nil {
+		webauthnLogger.Info(err.Error())
+		return nil, false
+	}
+	ad, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		webauthnLogger.Info(err.Error())
+		return nil, false
+	}
+	u, ok := session.realm.findUser(username)
+	if !ok {
+		return nil, false
+	}
+
+	credentials := session.realm.credentials
+	credentials.mu.Lock()
+	defer credentials.mu.Unlock()
+	var cred *webauthnCredential
+	for _, c := range credentials.users[username] {
+		if c.ID == body.CredentialID {
+			cred = c
+		}
+	}
+	if cred == nil {
+		return nil, false
+	}
+	clientDataHash := sha256.Sum256(rawClientData)
+	if err := verifyCOSESignature(cred.PublicKey, append(rawAuthData, clientDataHash[:]...), sig); err != nil {
+		webauthnLogger.Info(err.Error())
+		return nil, false
+	}
+	// A counter that does not increase means the credential was cloned.
+	if (ad.signCount != 0 || cred.SignCount != 0) && ad.signCount <= cred.SignCount {
+		webauthnLogger.Warningf("webauthn sign count did not increase for %s, possible cloned authenticator", username)
+		return nil, false
+	}
+	cred.SignCount = ad.signCount
+	if err := credentials.save(); err != nil {
+		webauthnLogger.Error(err.Error())
+	}
+	return u, true
+}
+
+// WebauthnRegisterBegin returns credential creation options for the
+// current user and keeps the challenge in the session.
+func WebauthnRegisterBegin(s service.Service, w http.ResponseWriter, req *http.Request, session *Session) {
+	username, logined := session.container["username"]
+	if !logined {
+		writeError(w, req, errLoginRequired, nil)
+		return
+	}
+	var exclude []map[string]string
+	for _, id := range session.realm.credentials.ids(username) {
+		exclude = append(exclude, map[string]string{"type": "public-key", "id": id})
+	}
+	var data Rsp
+	data.Code = "200"
+	data.Object = map[string]interface{}{
+		"challenge": newWebauthnChallenge(session, "webauthn_register"),
+		"rp":        map[string]string{"id": liveConfig().Daemon.RPID, "name": "simpleauth"},
+		"user": map[string]string{
+			"id":          b64url.EncodeToString([]byte(username)),
+			"name":        username,
+			"displayName": username,
+		},
+		"pubKeyCredParams": []map[string]interface{}{
+			{"type": "public-key", "alg": coseAlgES256},
+			{"type": "public-key", "alg": coseAlgEdDSA},
+		},
+		"excludeCredentials": exclude,
+		"timeout":            webauthnTimeout,
+		"attestation":        "none",
+	}
+	output(w, data)
+}
+
+type webauthnRegisterRequest struct {
+	CredentialID      string `json:"credential_id" validate:"max=1024"`
+	ClientDataJSON    string `json:"client_data_json" validate:"required,max=4096"`
+	AttestationObject string `json:"attestation_object" validate:"required,max=16384"`
+}
+
+// WebauthnRegisterFinish verifies the attestation and stores the new
+// credential. Attestation statements are not verified.
+func WebauthnRegisterFinish(s service.Service, w http.ResponseWriter, req *http.Request, session *Session) {
+	username, logined := session.container["username"]
+	if !logined {
+		writeError(w, req, errLoginRequired, nil)
+		return
+	}
+	challenge := takeWebauthnChallenge(session, "webauthn_register")
+	var body webauthnRegisterRequest
+	if !decodeRequest(w, req, &body) {
+		return
+	}
+	values, ok := decodeParams(body.ClientDataJSON, body.AttestationObject)
+	if !ok {
+		writeError(w, req, errBadParams, nil)
+		return
+	}
+	cred, err := parseAttestation(values[0], values[1], challenge)
+	if err == nil && body.CredentialID != "" && body.CredentialID != cred.ID {
+		err = errors.New("webauthn: credential ID does not match attestation")
+	}
+	if err == nil {
+		err = session.realm.credentials.add(username, cred)
+	}
+	if err != nil {
+		requestLogger(req).Info(err.Error())
+		audit.record(req, username, auditWebauthnRegister, "", outcomeFailure)
+		writeError(w, req, errWebauthn, nil)
+		return
+	}
+	audit.record(req, username, auditWebauthnRegister, cred.ID, outcomeSuccess)
+	var data Rsp
+	data.Code = "200"
+	data.Msg = msg(req, "webauthn_registered")
+	data.Object = map[string]string{"credential_id": cred.ID}
+	output(w, data)
+}
+
+func parseAttestation(rawClientData, rawAttestation []byte, challenge string) (*webauthnCredential, error) {
+	if err := checkClientData(rawClientData, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+	v, _, err := cborDecode(rawAttestation)
+	if err != nil {
+		return nil, err
+	}
+	att, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("webauthn: malformed attestation object")
+	}
+	rawAuthData, _ := att["authData"].([]byte)
+	ad, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if ad.credentialID == nil {
+		return nil, errors.New("webauthn: no attested credential")
+	}
+	if _, err := parseCOSEKey(ad.publicKey); err != nil {
+		return nil, err
+	}
+	return &webauthnCredential{
+		ID:        b64url.EncodeToString(ad.credentialID),
+		PublicKey: ad.publicKey,
+		SignCount: ad.signCount,
+	}, nil
+}
+
+type webauthnLoginRequest struct {
+	Username string `json:"username" validate:"required,max=64"`
+}
+
+// WebauthnLoginBegin returns assertion options for a user. The assertion
+// itself is sent to /token.
+func WebauthnLoginBegin(s service.Service, w http.ResponseWriter, req *http.Request, session *Session) {
+	var body webauthnLoginRequest
+	if !decodeRequest(w, req, &body) {
+		return
+	}
+	username := body.Username
+	session.set("webauthn_login_user", username)
+	var allow []map[string]string
+	for _, id := range session.realm.credentials.ids(username) {
+		allow = append(allow, map[string]string{"type": "public-key", "id": id})
+	}
+	var data Rsp
+	data.Code = "200"
+	data.Object = map[string]interface{}{
+		"challenge":        newWebauthnChallenge(session, "webauthn_login"),
+		"rpId":             liveConfig().Daemon.RPID,
+		"allowCredentials": allow,
+		"timeout":          webauthnTimeout,
+		"userVerification": "preferred",
+	}
+	output(w, data)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/liuzhiyi/daemon/softauthn"
+)
+
+// registerAuthenticator logs in as admin and registers a credential of a
+// new software authenticator, returning it and the credential ID.
+func registerAuthenticator(t *testing.T, base string) (*softauthn.Authenticator, string) {
+	t.Helper()
+	c := newClient(t)
+	login(t, c, base)
+	begin := postJSON(t, c, base+"/v1.0/webauthn/register/begin", nil)
+	challenge, _ := begin.Object["challenge"].(string)
+	if begin.Code != "200" || challenge == "" {
+		t.Fatalf("register begin: %+v", begin)
+	}
+	a := softauthn.New(cfg.Daemon.RPOrigin)
+	params, err := a.Register(cfg.Daemon.RPID, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	finish := postJSON(t, c, base+"/v1.0/webauthn/register/finish", params)
+	if finish.Code != "200" {
+		t.Fatalf("register finish: %+v", finish)
+	}
+	return a, params["credential_id"]
+}
+
+// loginChallenge starts a WebAuthn login for admin on c.
+func loginChallenge(t *testing.T, c *http.Client, base string) string {
+	t.Helper()
+	begin := postJSON(t, c, base+"/v1.0/webauthn/login/begin", map[string]string{"username": "admin"})
+	challenge, _ := begin.Object["challenge"].(string)
+	if begin.Code != "200" || challenge == "" {
+		t.Fatalf("login begin: %+v", begin)
+	}
+	return challenge
+}
+
+func TestWebauthnRegisterAndLogin(t *testing.T) {
+	srv := newTestServer(t)
+	a, id := registerAuthenticator(t, srv.URL)
+
+	c := newClient(t)
+	for i := 0; i < 2; i++ {
+		assertion, err := a.Assert(id, loginChallenge(t, c, srv.URL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp := postJSON(t, c, srv.URL+"/v1.0/token", assertion)
+		if rsp.Code != "200" || rsp.Object["token"] == "" {
+			t.Fatalf("login %d: %+v", i, rsp)
+		}
+	}
+}
+
+func TestWebauthnRegisterWrongOrigin(t *testing.T) {
+	srv := newTestServer(t)
+	c := newClient(t)
+	login(t, c, srv.URL)
+	begin := postJSON(t, c, srv.URL+"/v1.0/webauthn/register/begin", nil)
+	a := softauthn.New("https://phish.example")
+	params, err := a.Register(cfg.Daemon.RPID, begin.Object["challenge"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp := postJSON(t, c, srv.URL+"/v1.0/webauthn/register/finish", params); rsp.Code != errWebauthn.Code {
+		t.Fatalf("got %+v, want code %s", rsp, errWebauthn.Code)
+	}
+}
+
+func TestWebauthnLoginWrongOrigin(t *testing.T) {
+	srv := newTestServer(t)
+	a, id := registerAuthenticator(t, srv.URL)
+	a.Origin = "https://phish.example"
+
+	c := newClient(t)
+	assertion, err := a.Assert(id, loginChallenge(t, c, srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp := postJSON(t, c, srv.URL+"/v1.0/token", assertion); rsp.Code != errCredentials.Code {
+		t.Fatalf("got %+v, want code %s", rsp, errCredentials.Code)
+	}
+}
+
+func TestWebauthnReplayedChallenge(t *testing.T) {
+	srv := newTestServer(t)
+	a, id := registerAuthenticator(t, srv.URL)
+
+	c := newClient(t)
+	assertion, err := a.Assert(id, loginChallenge(t, c, srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp := postJSON(t, c, srv.URL+"/v1.0/token", assertion); rsp.Code != "200" {
+		t.Fatalf("first use: %+v", rsp)
+	}
+	if rsp := postJSON(t, c, srv.URL+"/v1.0/token", assertion); rsp.Code != errCredentials.Code {
+		t.Fatalf("replay: got %+v, want code %s", rsp, errCredentials.Code)
+	}
+}
+
+func TestWebauthnCounterBackwards(t *testing.T) {
+	srv := newTestServer(t)
+	a, id := registerAuthenticator(t, srv.URL)
+
+	c := newClient(t)
+	a.SetSignCount(id, 9)
+	assertion, err := a.Assert(id, loginChallenge(t, c, srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp := postJSON(t, c, srv.URL+"/v1.0/token", assertion); rsp.Code != "200" {
+		t.Fatalf("count 10: %+v", rsp)
+	}
+	// A clone still at an older count must be refused.
+	a.SetSignCount(id, 4)
+	assertion, err = a.Assert(id, loginChallenge(t, c, srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp := postJSON(t, c, srv.URL+"/v1.0/token", assertion); rsp.Code != errCredentials.Code {
+		t.Fatalf("count 5: got %+v, want code %s", rsp, errCredentials.Code)
+	}
+}
+
+func TestWebauthnExpiredChallenge(t *testing.T) {
+	srv := newTestServer(t)
+	a, id := registerAuthenticator(t, srv.URL)
+
+	c := newClient(t)
+	assertion, err := a.Assert(id, loginChallenge(t, c, srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := defaultRealm.webauthnChallenges
+	w.mu.Lock()
+	for key, ch := range w.challenges {
+		ch.expires = time.Now().Add(-time.Second)
+		w.challenges[key] = ch
+	}
+	w.mu.Unlock()
+	if rsp := postJSON(t, c, srv.URL+"/v1.0/token", assertion); rsp.Code != errCredentials.Code {
+		t.Fatalf("got %+v, want code %s", rsp, errCredentials.Code)
+	}
+}
+
+func TestWebauthnChallengesBounded(t *testing.T) {
+	newTestServer(t)
+	w := defaultRealm.webauthnChallenges
+	expired := &Session{sid: "expired", realm: defaultRealm}
+	newWebauthnChallenge(expired, "webauthn_login")
+	w.mu.Lock()
+	ch := w.challenges["webauthn_login\xffexpired"]
+	ch.expires = time.Now().Add(-time.Second)
+	w.challenges["webauthn_login\xffexpired"] = ch
+	w.mu.Unlock()
+	w.sweep()
+	if n := len(w.challenges); n != 0 {
+		t.Fatalf("%d challenges after sweep", n)
+	}
+
+	for i := 0; i < maxKeyChallenges+10; i++ {
+		newWebauthnChallenge(&Session{sid: fmt.Sprint(i), realm: defaultRealm}, "webauthn_login")
+	}
+	if n := len(w.challenges); n != maxKeyChallenges {
+		t.Fatalf("%d challenges, want %d", n, maxKeyChallenges)
+	}
+}
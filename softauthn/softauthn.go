@@ -0,0 +1,198 @@
+// Package softauthn is a software WebAuthn authenticator for exercising the
+// daemon's registration and login ceremonies without hardware. It produces
+// the flat base64url parameters the daemon's endpoints expect.
+package softauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+const (
+	flagUserPresent  = 0x01
+	flagAttestedData = 0x40
+)
+
+var b64url = base64.RawURLEncoding
+
+type credential struct {
+	rpID      string
+	key       *ecdsa.PrivateKey
+	signCount uint32
+}
+
+// Authenticator holds ES256 credentials in memory.
+type Authenticator struct {
+	// Origin is reported in the client data of every ceremony.
+	Origin string
+
+	mu          sync.Mutex
+	credentials map[string]*credential
+}
+
+func New(origin string) *Authenticator {
+	return &Authenticator{Origin: origin, credentials: make(map[string]*credential)}
+}
+
+func (a *Authenticator) clientData(typ, challenge string) []byte {
+	buf, _ := json.Marshal(map[string]string{
+		"type":      typ,
+		"challenge": challenge,
+		"origin":    a.Origin,
+	})
+	return buf
+}
+
+func authData(rpID string, flags byte, signCount uint32, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	buf := append([]byte(nil), rpIDHash[:]...)
+	buf = append(buf, flags)
+	var count [4]byte
+	binary.BigEndian.PutUint32(count[:], signCount)
+	buf = append(buf, count[:]...)
+	return append(buf, attested...)
+}
+
+// Register creates a credential for rpID answering challenge, the
+// base64url string from the creation options. It returns the parameters
+// for the registration finish endpoint.
+func (a *Authenticator) Register(rpID, challenge string) (map[string]string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	attested := make([]byte, 16) // zero AAGUID
+	var idLen [2]byte
+	binary.BigEndian.PutUint16(idLen[:], uint16(len(id)))
+	attested = append(attested, idLen[:]...)
+	attested = append(attested, id...)
+	attested = append(attested, coseKey(&key.PublicKey)...)
+
+	var att cborWriter
+	att.mapHeader(3)
+	att.text("fmt")
+	att.text("none")
+	att.text("attStmt")
+	att.mapHeader(0)
+	att.text("authData")
+	att.bytes(authData(rpID, flagUserPresent|flagAttestedData, 0, attested))
+
+	encodedID := b64url.EncodeToString(id)
+	a.mu.Lock()
+	a.credentials[encodedID] = &credential{rpID: rpID, key: key}
+	a.mu.Unlock()
+	return map[string]string{
+		"credential_id":      encodedID,
+		"client_data_json":   b64url.EncodeToString(a.clientData("webauthn.create", challenge)),
+		"attestation_object": b64url.EncodeToString(att.buf),
+	}, nil
+}
+
+// Assert signs challenge with the credential id, incrementing its sign
+// count, and returns the assertion parameters for /token.
+func (a *Authenticator) Assert(id, challenge string) (map[string]string, error) {
+	a.mu.Lock()
+	cred, ok := a.credentials[id]
+	if ok {
+		cred.signCount++
+	}
+	a.mu.Unlock()
+	if !ok {
+		return nil, errors.New("softauthn: unknown credential")
+	}
+	clientData := a.clientData("webauthn.get", challenge)
+	ad := authData(cred.rpID, flagUserPresent, cred.signCount, nil)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte(nil), ad...), clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, cred.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"credential_id":      id,
+		"client_data_json":   b64url.EncodeToString(clientData),
+		"authenticator_data": b64url.EncodeToString(ad),
+		"signature":          b64url.EncodeToString(sig),
+	}, nil
+}
+
+// SetSignCount overrides the counter of a credential, which lets callers
+// simulate a cloned authenticator.
+func (a *Authenticator) SetSignCount(id string, count uint32) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if cred, ok := a.credentials[id]; ok {
+		cred.signCount = count
+	}
+}
+
+func coseKey(pub *ecdsa.PublicKey) []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	pub.X.FillBytes(x)
+	pub.Y.FillBytes(y)
+	var w cborWriter
+	w.mapHeader(5)
+	w.int(1) // kty: EC2
+	w.int(2)
+	w.int(3) // alg: ES256
+	w.int(-7)
+	w.int(-1) // crv: P-256
+	w.int(1)
+	w.int(-2)
+	w.bytes(x)
+	w.int(-3)
+	w.bytes(y)
+	return w.buf
+}
+
+// cborWriter encodes the few CBOR items an attestation object needs.
+type cborWriter struct {
+	buf []byte
+}
+
+func (w *cborWriter) head(major byte, n uint64) {
+	switch {
+	case n < 24:
+		w.buf = append(w.buf, major<<5|byte(n))
+	case n < 1<<8:
+		w.buf = append(w.buf, major<<5|24, byte(n))
+	case n < 1<<16:
+		w.buf = append(w.buf, major<<5|25, byte(n>>8), byte(n))
+	default:
+		w.buf = append(w.buf, major<<5|26, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+}
+
+func (w *cborWriter) int(n int64) {
+	if n < 0 {
+		w.head(1, uint64(-1-n))
+	} else {
+		w.head(0, uint64(n))
+	}
+}
+
+func (w *cborWriter) bytes(b []byte) {
+	w.head(2, uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *cborWriter) text(s string) {
+	w.head(3, uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *cborWriter) mapHeader(n int) {
+	w.head(5, uint64(n))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/png"
+	"strings"
+)
+
+// captchaArt draws the PNG of a captcha challenge, sent as a data URI,
+// as text for the terminal. Each character covers 2x2 pixels and is drawn
+// when most of them are dark: the question is drawn dark on a light,
+// noisy background.
+func captchaArt(uri string) (string, error) {
+	const prefix = "data:image/png;base64,"
+	if !strings.HasPrefix(uri, prefix) {
+		return "", errors.New("captcha: no image")
+	}
+	buf, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(uri, prefix))
+	if err != nil {
+		return "", err
+	}
+	img, err := png.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return "", err
+	}
+	const cellW, cellH = 2, 2
+	b := img.Bounds()
+	var out strings.Builder
+	for y := b.Min.Y; y+cellH <= b.Max.Y; y += cellH {
+		line := make([]byte, 0, b.Dx()/cellW)
+		for x := b.Min.X; x+cellW <= b.Max.X; x += cellW {
+			if darkPixels(img, x, y, cellW, cellH)*2 > cellW*cellH {
+				line = append(line, '#')
+			} else {
+				line = append(line, ' ')
+			}
+		}
+		if s := strings.TrimRight(string(line), " "); s != "" {
+			out.WriteString(" " + s + "\n")
+		}
+	}
+	return out.String(), nil
+}
+
+// darkPixels counts the dark pixels of the w by h block of img at x, y.
+func darkPixels(img image.Image, x, y, w, h int) int {
+	n := 0
+	for dy := 0; dy < h; dy++ {
+		for dx := 0; dx < w; dx++ {
+			r, g, b, _ := img.At(x+dx, y+dy).RGBA()
+			// Luma on the 16-bit scale; the ink is far darker than the
+			// lightest noise.
+			if (299*r+587*g+114*b)/1000 < 0x6000 {
+				n++
+			}
+		}
+	}
+	return n
+}
@@ -8,6 +8,8 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -53,8 +55,12 @@ func (c *DaemonCli) call(method, path string, data interface{}, passAuthInfo boo
 		return nil, -1, err
 	}
 	if passAuthInfo {
+		if token := authToken(); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
 	}
 	req.Header.Set("User-Agent", "Daemon-Client/")
+	req.Header.Set("Accept-Language", c.lang)
 	req.URL.Host = c.addr
 	req.URL.Scheme = c.scheme
 	if data != nil {
@@ -65,10 +71,10 @@ func (c *DaemonCli) call(method, path string, data interface{}, passAuthInfo boo
 	rsp, err := c.HTTPClient().Do(req)
 	if err != nil {
 		if strings.Contains(err.Error(), "connection refused") {
-			return nil, -1, errors.New("connection refused")
+			return nil, -1, errors.New(c.tr("connection_refused"))
 		}
 
-		return nil, -1, fmt.Errorf("An error occurred trying to connect: %v", err)
+		return nil, -1, errors.New(c.tr("connect_failed", err))
 	}
 
 	if rsp.StatusCode < 200 || rsp.StatusCode >= 400 {
@@ -79,12 +85,18 @@ func (c *DaemonCli) call(method, path string, data interface{}, passAuthInfo boo
 		if len(body) == 0 {
 			return nil, rsp.StatusCode, fmt.Errorf("Error: request returned %s for API route and version %s, check if the server supports the requested API version", http.StatusText(rsp.StatusCode), req.URL)
 		}
-		return nil, rsp.StatusCode, fmt.Errorf("Error response from daemon: %s", bytes.TrimSpace(body))
+		if e := decodeError(rsp.StatusCode, body); e != nil {
+			return nil, rsp.StatusCode, e
+		}
+		return nil, rsp.StatusCode, errors.New(c.tr("daemon_error", bytes.TrimSpace(body)))
 	}
 
 	return rsp.Body, rsp.StatusCode, nil
 }
 
+// jsonHeaders marks a streamed request body as JSON.
+var jsonHeaders = map[string][]string{"Content-Type": {"application/json"}}
+
 func (c *DaemonCli) stream(method, path string, in io.Reader, stdout, stderr io.Writer, headers map[string][]string) error {
 	if (method == "POST" || method == "PUT") && in == nil {
 		in = bytes.NewReader([]byte{})
@@ -95,11 +107,15 @@ func (c *DaemonCli) stream(method, path string, in io.Reader, stdout, stderr io.
 		return err
 	}
 	req.Header.Set("User-Agent", "Docker-Client/")
+	req.Header.Set("Accept-Language", c.lang)
 	req.URL.Host = c.addr
 	req.URL.Scheme = c.scheme
 	if method == "POST" {
 		req.Header.Set("Content-Type", "text/plain")
 	}
+	if token := authToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
 
 	if headers != nil {
 		for k, v := range headers {
@@ -109,7 +125,7 @@ func (c *DaemonCli) stream(method, path string, in io.Reader, stdout, stderr io.
 	resp, err := c.HTTPClient().Do(req)
 	if err != nil {
 		if strings.Contains(err.Error(), "connection refused") {
-			return fmt.Errorf("Cannot connect to the Docker daemon.")
+			return errors.New(c.tr("connection_refused"))
 		}
 		return err
 	}
@@ -121,7 +137,10 @@ func (c *DaemonCli) stream(method, path string, in io.Reader, stdout, stderr io.
 			return err
 		}
 		if len(body) == 0 {
-			return fmt.Errorf("Error :%s", http.StatusText(resp.StatusCode))
+			return errors.New(c.tr("http_error", resp.StatusCode, http.StatusText(resp.StatusCode)))
+		}
+		if e := decodeError(resp.StatusCode, body); e != nil {
+			return e
 		}
 		return fmt.Errorf("Error: %s", bytes.TrimSpace(body))
 	}
@@ -137,42 +156,140 @@ func (c *DaemonCli) stream(method, path string, in io.Reader, stdout, stderr io.
 	return nil
 }
 
+// readLine prompts for and reads one line of input.
+func (c *DaemonCli) readLine(prompt string) (string, error) {
+	fmt.Fprint(c.out, prompt)
+	buf := make([]byte, 100)
+	n, err := c.in.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(buf[:n]), "\r\n"), nil
+}
+
 func (c *DaemonCli) CmdLogin(args ...string) error {
 	data := make(map[string]string)
-	fmt.Fprint(c.out, "\n user :")
-	buf := make([]byte, 100)
+	var err error
+	if data["username"], err = c.readLine(c.tr("prompt_user")); err != nil {
+		return err
+	} else if data["username"] == "" {
+		return errors.New(c.tr("user_empty"))
+	}
+	if *flIdentity != "" {
+		if data, err = c.keyLogin(*flIdentity, data["username"]); err != nil {
+			return err
+		}
+	} else if data["password"], err = c.readLine(c.tr("prompt_password")); err != nil {
+		return err
+	} else if data["password"] == "" {
+		return errors.New(c.tr("password_empty"))
+	}
+	if len(args) > 0 {
+		data["scope"] = strings.Join(args, " ")
+	}
+	if *flOtp != "" {
+		data["otp"] = *flOtp
+	}
+	for {
+		body, _, err := c.readBody(c.call("POST", "/token", data, false))
+		if e, ok := isError(err, codeOTPRequired); ok && data["otp"] == "" {
+			// New device: ask for the one-time password.
+			fmt.Fprintf(c.out, "\n %s\n", e.Msg)
+			if data["otp"], err = c.readLine(c.tr("prompt_otp")); err != nil {
+				return err
+			}
+			continue
+		}
+		e, captcha := isError(err, codeCaptchaRequired)
+		if !captcha {
+			if err != nil {
+				return err
+			}
+			if _, err = c.out.Write(body); err != nil {
+				return err
+			}
+			return c.saveToken(body)
+		}
+		if err := c.answerCaptcha(e, data); err != nil {
+			return err
+		}
+	}
+}
+
+// tokenPath is where login saves the access token for later commands.
+func tokenPath() string {
+	return filepath.Join(filepath.Dir(defaultKeyPath()), "token")
+}
+
+// authToken returns the access token to send: -token, else the one saved
+// by the last login.
+func authToken() string {
+	if *flToken != "" {
+		return *flToken
+	}
+	buf, err := ioutil.ReadFile(tokenPath())
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(buf))
+}
 
-	if n, err := c.in.Read(buf); err != nil {
+// saveToken keeps the token of a login response, readable only by the
+// user, so that later commands authenticate with it.
+func (c *DaemonCli) saveToken(body []byte) error {
+	var rsp struct {
+		Object map[string]string
+	}
+	if err := json.Unmarshal(body, &rsp); err != nil || rsp.Object["token"] == "" {
 		return err
-	} else if n <= 0 {
-		return fmt.Errorf("user is empty")
 	}
-	data["username"] = string(buf[:strings.Index(string(buf), "\r\n")])
-	fmt.Fprint(c.out, "\n password :")
-	if n, err := c.in.Read(buf); err != nil {
+	path := tokenPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
 		return err
-	} else if n <= 0 {
-		return fmt.Errorf("passwd is empty")
 	}
-	data["password"] = string(buf[:strings.Index(string(buf), "\r\n")])
-	in, err := c.encodeData(data)
+	if err := ioutil.WriteFile(path, []byte(rsp.Object["token"]), 0600); err != nil {
+		return err
+	}
+	fmt.Fprint(c.out, c.tr("token_saved", path))
+	return nil
+}
+
+// answerCaptcha asks for the answer to the challenge sent with a
+// captcha_required error, after too many failed logins, and adds it to
+// the request data for the next try.
+func (c *DaemonCli) answerCaptcha(e *apiError, data map[string]string) error {
+	var challenge map[string]string
+	if err := json.Unmarshal(e.Object, &challenge); err != nil {
+		return err
+	}
+	art, err := captchaArt(challenge["image"])
 	if err != nil {
 		return err
 	}
-	return c.stream("POST", "/token", in, c.out, c.err, nil)
+	fmt.Fprintf(c.out, "\n %s\n\n%s", e.Msg, art)
+	answer, err := c.readLine(c.tr("prompt_captcha"))
+	if err != nil {
+		return err
+	}
+	data["captcha_id"] = challenge["captcha_id"]
+	data["captcha_answer"] = answer
+	return nil
 }
 
 func (c *DaemonCli) CmdReset(args ...string) error {
-	if len(args) < 1 {
-		return fmt.Errorf("Not enough parameters")
+	// With a client certificate the password may be left out.
+	if len(args) < 1 && *flCert == "" {
+		return errors.New(c.tr("not_enough_params"))
 	}
 	data := make(map[string]string)
-	data["password"] = args[0]
+	if len(args) > 0 {
+		data["password"] = args[0]
+	}
 	in, err := c.encodeData(data)
 	if err != nil {
 		return err
 	}
-	return c.stream("POST", "/reset", in, c.out, c.err, nil)
+	return c.stream("POST", "/reset", in, c.out, c.err, jsonHeaders)
 }
 
 func (c *DaemonCli) CmdVersion(args ...string) error {
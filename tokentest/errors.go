@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Error codes returned by the daemon.
+const (
+	codeSystem          = "100"
+	codeDecode          = "201"
+	codeCredentials     = "202"
+	codeForbidden       = "203"
+	codeOTPRequired     = "204"
+	codeCaptchaRequired = "205"
+	codeWebauthn        = "206"
+	codeLoginRequired   = "207"
+	codeWrongPassword   = "208"
+	codeRestartFailed   = "209"
+	codeBadParams       = "301"
+	codeUnsupportedType = "302"
+	codeBodyTooLarge    = "303"
+)
+
+// apiError is an error response of the daemon.
+type apiError struct {
+	Status int `json:"-"`
+	Code   string
+	Key    string
+	Msg    string
+	Object json.RawMessage
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("Error response from daemon: %s %s (%s)", e.Code, e.Msg, http.StatusText(e.Status))
+}
+
+// decodeError returns the apiError carried by body, or nil when body is
+// not an error response of the daemon.
+func decodeError(status int, body []byte) *apiError {
+	e := &apiError{Status: status}
+	if err := json.Unmarshal(body, e); err != nil || e.Code == "" {
+		return nil
+	}
+	return e
+}
+
+// isError reports whether err is an error response with code.
+func isError(err error, code string) (*apiError, bool) {
+	e, ok := err.(*apiError)
+	return e, ok && e.Code == code
+}
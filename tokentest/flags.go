@@ -4,22 +4,27 @@ import (
 	"flag"
 	"fmt"
 	"os"
+
+	"github.com/liuzhiyi/daemon/common"
 )
 
 var (
-	flTls  = flag.Bool("-tls", false, "enable daemon mode")
-	flHost = flag.String("-host", "", "set host")
+	flTls      = flag.Bool("tls", false, "connect to the daemon over HTTPS")
+	flCACert   = flag.String("cacert", "", "trust only certificates signed by this CA, implies -tls")
+	flCert     = flag.String("cert", "", "client certificate to authenticate with, implies -tls")
+	flKey      = flag.String("key", "", "private key of the client certificate")
+	flOtp      = flag.String("otp", "", "one-time password for logins from a new device")
+	flIdentity = flag.String("identity", "", "private key file for public-key login")
+	flToken    = flag.String("token", "", "access token to send, default the one saved by login")
+	flLocale   = flag.String("locale", "", "message language, zh-CN or en (default $SIMPLEAUTH_LOCALE or $LANG)")
 )
 
 func init() {
 	flag.Usage = func() {
-		fmt.Fprint(os.Stdout, "Usage: tokentest [OPTIONS] COMMAND [arg...]\n\nOptions:\n")
+		lang := common.Locale(*flLocale, common.LangEN)
+		fmt.Fprint(os.Stdout, tr(lang, "usage"))
 		flag.PrintDefaults()
 		flag.CommandLine.SetOutput(os.Stdout)
-		help := `Commands:
-            reset:      restart service
-            login:      get a token of access
-            wlecome:    welcome`
-		fmt.Fprint(os.Stdout, help)
+		fmt.Fprint(os.Stdout, tr(lang, "help"))
 	}
 }
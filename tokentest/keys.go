@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	pemPrivateKey          = "PRIVATE KEY"
+	pemEncryptedPrivateKey = "ENCRYPTED ED25519 PRIVATE KEY"
+	pemPublicKey           = "ED25519 PUBLIC KEY"
+	kdfIterations          = 200000
+)
+
+func defaultKeyPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	return filepath.Join(home, ".simpleauth", "id_ed25519")
+}
+
+func keyCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(passphrase), salt, kdfIterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encodePrivateKey returns key as PEM, sealed with passphrase unless it is
+// empty.
+func encodePrivateKey(key ed25519.PrivateKey, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: pemPrivateKey, Bytes: der}), nil
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := keyCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type: pemEncryptedPrivateKey,
+		Headers: map[string]string{
+			"KDF":        "pbkdf2-sha256",
+			"Iterations": strconv.Itoa(kdfIterations),
+			"Salt":       hex.EncodeToString(salt),
+			"Nonce":      hex.EncodeToString(nonce),
+		},
+		Bytes: aead.Seal(nil, nonce, key.Seed(), nil),
+	}), nil
+}
+
+// loadPrivateKey reads a key written by CmdKeyGen, asking for the
+// passphrase when the key is encrypted.
+func (c *DaemonCli) loadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	switch block.Type {
+	case pemPrivateKey:
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		edKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: not an ed25519 key", path)
+		}
+		return edKey, nil
+	case pemEncryptedPrivateKey:
+		salt, err := hex.DecodeString(block.Headers["Salt"])
+		if err != nil {
+			return nil, err
+		}
+		nonce, err := hex.DecodeString(block.Headers["Nonce"])
+		if err != nil {
+			return nil, err
+		}
+		passphrase, err := c.readLine(c.tr("prompt_passphrase"))
+		if err != nil {
+			return nil, err
+		}
+		aead, err := keyCipher(passphrase, salt)
+		if err != nil {
+			return nil, err
+		}
+		if len(nonce) != aead.NonceSize() {
+			return nil, fmt.Errorf("%s: bad nonce", path)
+		}
+		seed, err := aead.Open(nil, nonce, block.Bytes, nil)
+		if err != nil {
+			return nil, errors.New(c.tr("wrong_passphrase"))
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	return nil, fmt.Errorf("%s: unexpected PEM type %q", path, block.Type)
+}
+
+func readPublicKey(path string) (ed25519.PublicKey, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil || block.Type != pemPublicKey || len(block.Bytes) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%s: not an ed25519 public key", path)
+	}
+	return ed25519.PublicKey(block.Bytes), nil
+}
+
+// CmdKeyGen creates an ed25519 key pair for public-key login.
+// Usage: key gen [path]
+func (c *DaemonCli) CmdKeyGen(args ...string) error {
+	path := defaultKeyPath()
+	if len(args) > 0 {
+		path = args[0]
+	}
+	if _, err := os.Stat(path); err == nil {
+		return errors.New(c.tr("key_exists", path))
+	}
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	passphrase, err := c.readLine(c.tr("prompt_new_passphrase"))
+	if err != nil {
+		return err
+	}
+	keyPEM, err := encodePrivateKey(key, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, keyPEM, 0600); err != nil {
+		return err
+	}
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: pemPublicKey, Bytes: pub})
+	if err := ioutil.WriteFile(path+".pub", pubPEM, 0644); err != nil {
+		return err
+	}
+	fmt.Fprint(c.out, c.tr("key_written", path, path))
+	return nil
+}
+
+// CmdKeyRegister uploads a public key, authenticating once with the
+// password.
+// Usage: key register [path.pub]
+func (c *DaemonCli) CmdKeyRegister(args ...string) error {
+	path := defaultKeyPath() + ".pub"
+	if len(args) > 0 {
+		path = args[0]
+	}
+	pub, err := readPublicKey(path)
+	if err != nil {
+		return err
+	}
+	data := make(map[string]string)
+	if data["username"], err = c.readLine(c.tr("prompt_user")); err != nil {
+		return err
+	}
+	if data["password"], err = c.readLine(c.tr("prompt_password")); err != nil {
+		return err
+	}
+	data["public_key"] = base64.StdEncoding.EncodeToString(pub)
+	for {
+		in, err := c.encodeData(data)
+		if err != nil {
+			return err
+		}
+		err = c.stream("POST", "/keys", in, c.out, c.err, jsonHeaders)
+		e, captcha := isError(err, codeCaptchaRequired)
+		if !captcha {
+			return err
+		}
+		if err := c.answerCaptcha(e, data); err != nil {
+			return err
+		}
+	}
+}
+
+// keyLogin answers a login challenge with the private key at path and
+// returns the /token parameters carrying the signature.
+func (c *DaemonCli) keyLogin(path, username string) (map[string]string, error) {
+	key, err := c.loadPrivateKey(path)
+	if err != nil {
+		return nil, err
+	}
+	body, _, err := c.readBody(c.call("POST", "/challenge", map[string]string{"username": username}, false))
+	if err != nil {
+		return nil, err
+	}
+	var rsp struct {
+		Code   string
+		Msg    string
+		Object map[string]string
+	}
+	if err := json.Unmarshal(body, &rsp); err != nil {
+		return nil, err
+	}
+	if rsp.Code != "200" {
+		return nil, fmt.Errorf("%s", rsp.Msg)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(rsp.Object["nonce"])
+	if err != nil {
+		return nil, err
+	}
+	msg := []byte("simpleauth-login\n" + username + "\n" + base64.StdEncoding.EncodeToString(nonce))
+	return map[string]string{
+		"username":     username,
+		"challenge_id": rsp.Object["challenge_id"],
+		"signature":    base64.StdEncoding.EncodeToString(ed25519.Sign(key, msg)),
+	}, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/liuzhiyi/daemon/common"
+)
+
+// messages is the catalog of CLI output, keyed by message key.
+var messages = common.Messages{
+	common.LangEN: {
+		"usage": "Usage: tokentest [OPTIONS] COMMAND [arg...]\n\nOptions:\n",
+		"help": `Commands:
+            reset:      restart service
+            login:      get a token of access, optionally limited to scopes
+            key gen:    create a key pair for public-key login
+            key register: register a public key with the daemon
+            config check: show the settings in effect and validate them
+            wlecome:    welcome`,
+		"not_a_command":         "'%s' is not a command. See '--help'.\n",
+		"not_enough_params":     "Not enough parameters",
+		"connection_refused":    "connection refused",
+		"connect_failed":        "An error occurred trying to connect: %v",
+		"daemon_error":          "Error response from daemon: %s",
+		"http_error":            "Error response from daemon: %d %s",
+		"prompt_user":           "\n user :",
+		"prompt_password":       "\n password :",
+		"prompt_otp":            " otp :",
+		"prompt_captcha":        " answer :",
+		"prompt_passphrase":     "\n passphrase :",
+		"prompt_new_passphrase": "\n passphrase (empty for none) :",
+		"user_empty":            "user is empty",
+		"password_empty":        "passwd is empty",
+		"wrong_passphrase":      "wrong passphrase",
+		"key_exists":            "%s already exists",
+		"key_written":           "\n private key: %s\n public key:  %s.pub\n",
+		"token_saved":           "\n token saved to %s\n",
+	},
+	common.LangZH: {
+		"usage": "用法: tokentest [选项] 命令 [参数...]\n\n选项:\n",
+		"help": `命令:
+            reset:      重启服务
+            login:      获取访问令牌，可限定权限范围
+            key gen:    生成用于公钥登录的密钥对
+            key register: 向服务注册公钥
+            config check: 显示并校验当前生效的配置
+            wlecome:    欢迎`,
+		"not_a_command":         "'%s' 不是有效的命令，请查看 '--help'。\n",
+		"not_enough_params":     "参数不足",
+		"connection_refused":    "连接被拒绝",
+		"connect_failed":        "连接时发生错误: %v",
+		"daemon_error":          "服务返回错误: %s",
+		"http_error":            "服务返回错误: %d %s",
+		"prompt_user":           "\n 用户名 :",
+		"prompt_password":       "\n 密码 :",
+		"prompt_otp":            " 动态口令 :",
+		"prompt_captcha":        " 答案 :",
+		"prompt_passphrase":     "\n 私钥口令 :",
+		"prompt_new_passphrase": "\n 私钥口令 (留空表示不加密) :",
+		"user_empty":            "用户名为空",
+		"password_empty":        "密码为空",
+		"wrong_passphrase":      "私钥口令不正确",
+		"key_exists":            "%s 已存在",
+		"key_written":           "\n 私钥: %s\n 公钥: %s.pub\n",
+		"token_saved":           "\n 令牌已保存到 %s\n",
+	},
+}
+
+// tr returns the message for key in the CLI language, formatted with args.
+func (c *DaemonCli) tr(key string, args ...interface{}) string {
+	return tr(c.lang, key, args...)
+}
+
+func tr(lang, key string, args ...interface{}) string {
+	if len(args) == 0 {
+		return messages.Get(lang, key)
+	}
+	return fmt.Sprintf(messages.Get(lang, key), args...)
+}
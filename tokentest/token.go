@@ -1,10 +1,10 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"os/exec"
@@ -15,18 +15,20 @@ import (
 	"github.com/kardianos/osext"
 	"github.com/kardianos/service"
 	"github.com/liuzhiyi/daemon/common"
+	"github.com/liuzhiyi/daemon/config"
+	"github.com/liuzhiyi/daemon/logging"
 )
 
 const (
 	version string = "1.0"
 	proto   string = "tcp"
-	addr    string = "127.0.0.1:3000"
-	helper         = "helper.exe"
 )
 
 var (
-	logger service.Logger
-	s      service.Service
+	logger       = logging.New(os.Stderr)
+	s            service.Service
+	configLoader = config.NewLoader(flag.CommandLine, "client")
+	cfg          = config.Default()
 )
 
 type DaemonCli struct {
@@ -36,21 +38,26 @@ type DaemonCli struct {
 	in        io.ReadCloser
 	out       io.Writer
 	err       io.Writer
+	lang      string
 	transport *http.Transport
 }
 
-func NewDaemonCli() *DaemonCli {
+func NewDaemonCli(tlsConfig *tls.Config) *DaemonCli {
 	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
 	tr := &http.Transport{
-	//TLSClientConfig: tlsConfig,
+		TLSClientConfig: tlsConfig,
 	}
 	return &DaemonCli{
 		proto:     proto,
-		addr:      addr,
+		addr:      cfg.Client.Host,
 		scheme:    scheme,
 		in:        os.Stdin,
 		out:       os.Stdout,
 		err:       os.Stderr,
+		lang:      common.Locale(*flLocale, common.LangEN),
 		transport: tr,
 	}
 }
@@ -81,7 +88,7 @@ func (c *DaemonCli) Cmd(args ...string) error {
 	if len(args) > 0 {
 		method, exists := c.getMethod(args[0])
 		if !exists {
-			fmt.Fprintf(c.err, "'%s' is not a command. See '--help'.\n", args[0])
+			fmt.Fprint(c.err, c.tr("not_a_command", args[0]))
 			os.Exit(1)
 		}
 		return method(args[1:]...)
@@ -100,7 +107,7 @@ func (c *DaemonCli) CmdHelp(args ...string) error {
 	if len(args) > 0 {
 		method, exists := c.getMethod(args[0])
 		if !exists {
-			fmt.Fprintf(c.err, "'%s' is not a command. See '--help'.\n", args[0])
+			fmt.Fprint(c.err, c.tr("not_a_command", args[0]))
 			os.Exit(1)
 		} else {
 			method("--help")
@@ -115,41 +122,66 @@ func (c *DaemonCli) CmdHelp(args ...string) error {
 
 func main() {
 	flag.Parse()
-	if len(*flHost) == 0 {
-		*flHost = addr
+	args := flag.Args()
+
+	var err error
+	cfg, err = configLoader.Load()
+	if len(args) == 2 && args[0] == "config" && args[1] == "check" {
+		if cfg != nil {
+			err = cfg.Check(os.Stdout, "client")
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err != nil {
+		logger.Fatal(err)
 	}
+	logger.SetLevel(cfg.Client.LogLevel)
+	logger.SetFormat(cfg.Client.LogFormat)
 	svcConfig := &service.Config{
-		Name:        "tokentest",
+		Name:        cfg.Client.ServiceName,
 		DisplayName: "Api Service",
 		Description: "This is a Api Go service.",
 	}
 	prg := &program{}
-	var err error
 	s, err = service.New(prg, svcConfig)
 	if err != nil {
-		log.Fatal(err.Error())
+		logger.Fatal(err.Error())
 	}
 	errs := make(chan error, 5)
-	logger, err = s.Logger(errs)
+	svcLogger, err := s.Logger(errs)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err)
+	}
+	if !service.Interactive() {
+		// Log to the log file when one is set, else to the service
+		// manager.
+		c := cfg.Client
+		defer logger.ServiceOutput(svcLogger, c.LogFile, config.Rotation(c.LogMaxSize, c.LogMaxAge, c.LogMaxBackups)).Close()
 	}
 
 	go func() {
 		for {
 			err := <-errs
 			if err != nil {
-				log.Print(err)
+				// Not through logger, which would forward it again.
+				fmt.Fprintln(os.Stderr, err)
 			}
 		}
 	}()
 
-	cli := NewDaemonCli()
-	if *flTls {
-		cli.scheme = "https"
+	var tlsConfig *tls.Config
+	if *flTls || *flCACert != "" || *flCert != "" {
+		if tlsConfig, err = common.ClientTLSConfig(*flCACert, *flCert, *flKey); err != nil {
+			logger.Fatal(err)
+		}
 	}
-	if len(flag.Args()) > 0 {
-		if err := cli.Cmd(flag.Args()...); err != nil {
+	cli := NewDaemonCli(tlsConfig)
+	if len(args) > 0 {
+		if err := cli.Cmd(args...); err != nil {
 			fmt.Fprint(cli.err, err.Error())
 		}
 		return
@@ -179,18 +211,23 @@ func (p *program) Start(s service.Service) error {
 
 func (p *program) run(s service.Service) error {
 	checkHelper()
-	common.Timer(60*time.Second, checkHelper)
+	common.Timer(time.Duration(cfg.Client.CheckInterval), checkHelper)
 	return nil
 }
 
 func checkHelper() {
-	if !common.IsRunning(helper) {
+	running, err := common.IsRunning(cfg.Client.Helper)
+	if err != nil {
+		logger.Errorf("wmi:%s", err.Error())
+		return
+	}
+	if !running {
 		startHelper()
 	}
 }
 
 func startHelper() error {
-	cmd := exec.Command(helper, "start")
+	cmd := exec.Command(cfg.Client.Helper, "start")
 	cmd.Dir, _ = osext.ExecutableFolder()
 	return cmd.Start()
 }